@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/1password/kubernetes-secrets-injector/pkg/opbin"
+)
+
+// copyOP runs the copy-op subcommand, which copies the OP CLI binary bundled in the injector image
+// into the volume shared with the injected containers. It runs in the injector image, which has no shell.
+func copyOP(args []string) int {
+	flags := flag.NewFlagSet("copy-op", flag.ContinueOnError)
+	source := flags.String("source", bundledOPPath, "Path of the bundled OP CLI binary.")
+	destination := flags.String("destination", "", "Path the OP CLI binary is copied to.")
+	checksums := flags.String("sha256", "", "Comma separated SHA-256 checksums allowed for the OP CLI binary.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *destination == "" || *checksums == "" {
+		fmt.Fprintln(os.Stderr, "copy-op: -destination and -sha256 are required")
+		return 2
+	}
+
+	if err := opbin.Copy(*source, *destination, strings.Split(*checksums, ",")); err != nil {
+		fmt.Fprintf(os.Stderr, "copy-op: %v\n", err)
+		return 1
+	}
+	fmt.Printf("copy-op: copied %s to %s\n", *source, *destination)
+	return 0
+}
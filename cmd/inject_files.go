@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/1password/kubernetes-secrets-injector/pkg/opbin"
+)
+
+// injectFiles runs the inject-files subcommand, which renders the secret files with the OP CLI binary
+// copied into the volume shared with the injected containers. It runs in the injector image, which has no shell.
+func injectFiles(args []string) int {
+	var dotenvs []opbin.Dotenv
+	flags := flag.NewFlagSet("inject-files", flag.ContinueOnError)
+	op := flags.String("op", "", "Path of the OP CLI binary.")
+	templates := flags.String("templates", "", "Directory of the templates of the secret files.")
+	destination := flags.String("destination", "", "Directory the secret files are rendered into.")
+	flags.Func("dotenv", "Dotenv file to render, as <file name>=<environment variable holding its template>. Can be repeated.", func(value string) error {
+		name, env, ok := strings.Cut(value, "=")
+		if !ok || name == "" || env == "" {
+			return fmt.Errorf("expected <file name>=<environment variable>, got %q", value)
+		}
+		dotenvs = append(dotenvs, opbin.Dotenv{Name: name, Template: os.Getenv(env)})
+		return nil
+	})
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *op == "" || *destination == "" {
+		fmt.Fprintln(os.Stderr, "inject-files: -op and -destination are required")
+		return 2
+	}
+
+	if err := opbin.InjectFiles(*op, *templates, *destination, dotenvs); err != nil {
+		fmt.Fprintf(os.Stderr, "inject-files: %v\n", err)
+		return 1
+	}
+	return 0
+}
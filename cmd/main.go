@@ -3,37 +3,171 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"expvar"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/1password/kubernetes-secrets-injector/pkg/opbin"
+	"github.com/1password/kubernetes-secrets-injector/pkg/registry"
 	"github.com/1password/kubernetes-secrets-injector/pkg/webhook"
 	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var (
 	webhookNamespace, webhookServiceName string
+	resolveImageCommand                  bool
+	opImageDigests, opImagePullPolicy    string
+	opImagePullSecrets                   string
+	initCPURequest, initMemoryRequest    string
+	initCPULimit, initMemoryLimit        string
+	bundledOPImage, bundledOPVersion     string
+	opImageVolume                        bool
+	opChecksums                          string
+	credentialsPolicy                    string
+	recordEvents                         bool
+	audit                                bool
+	credentialsType                      string
+	protectInjection                     bool
+	workloads, workloadTemplates         string
+	objectSelector                       string
 )
 
+// bundledOPPath is where the OP CLI binary is shipped in the injector image.
+const bundledOPPath = "/usr/local/bin/op"
+
 func init() {
 	// webhook server running namespace
 	webhookNamespace = os.Getenv("POD_NAMESPACE")
+	// version of the OP CLI shipped in the injector image
+	bundledOPVersion = os.Getenv("OP_BUNDLED_VERSION")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == webhook.CopyOPCommand {
+		os.Exit(copyOP(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == webhook.InjectFilesCommand {
+		os.Exit(injectFiles(os.Args[2:]))
+	}
+
 	var parameters webhook.SecretInjectorParameters
 	flag.IntVar(&parameters.Port, "port", 8443, "Webhook server port.")
 	flag.StringVar(&webhookServiceName, "service-name", "secrets-injector-svc", "Webhook service name.")
+	flag.BoolVar(&resolveImageCommand, "resolve-image-command", false, "Resolve the image ENTRYPOINT and CMD from the registry for containers that do not define a command. Requires the get permission on secrets, to read the image pull secrets of the pods.")
+	flag.StringVar(&parameters.CLIImage.Registry, "op-image-registry", "", "Registry of the 1Password CLI image, Docker Hub by default.")
+	flag.StringVar(&parameters.CLIImage.Repository, "op-image-repository", "1password/op", "Repository of the 1Password CLI image.")
+	flag.StringVar(&opImageDigests, "op-image-digests", "", "Comma separated <version>=<digest> pairs pinning the 1Password CLI image of a version to a digest.")
+	flag.StringVar(&opImagePullPolicy, "op-image-pull-policy", string(corev1.PullIfNotPresent), "Pull policy of the 1Password CLI image.")
+	flag.StringVar(&opImagePullSecrets, "op-image-pull-secrets", "", "Comma separated image pull secrets added to the mutated pods to pull the 1Password CLI image.")
+	flag.StringVar(&initCPURequest, "init-container-cpu-request", "10m", "CPU request of the injected init containers, unset when empty.")
+	flag.StringVar(&initMemoryRequest, "init-container-memory-request", "32Mi", "Memory request of the injected init containers, unset when empty.")
+	flag.StringVar(&initCPULimit, "init-container-cpu-limit", "", "CPU limit of the injected init containers, unset when empty.")
+	flag.StringVar(&initMemoryLimit, "init-container-memory-limit", "128Mi", "Memory limit of the injected init containers, unset when empty.")
+	flag.StringVar(&bundledOPImage, "bundled-op-image", "", "Image of the injector, used to copy the 1Password CLI bundled in it instead of pulling the 1Password CLI image. Disabled when empty.")
+	flag.BoolVar(&opImageVolume, "op-image-volume", false, "Mount the 1Password CLI from an image volume instead of copying it with an init container, when the cluster supports image volumes.")
+	flag.StringVar(&opChecksums, "op-checksums", "", "Comma separated <version>=<sha256> pairs allowing the checksums of the 1Password CLI binary of a version. A version can be listed once per architecture.")
+	flag.StringVar(&credentialsPolicy, "credentials-policy", string(webhook.CredentialsPolicyWarn), "What to do with pods whose injected containers have no 1Password CLI credentials: ignore, warn or deny.")
+	flag.BoolVar(&recordEvents, "record-events", true, "Record Kubernetes events about the injection on the workloads of the injected pods.")
+	flag.BoolVar(&audit, "audit", false, "Audit the injection in all namespaces instead of enforcing it: pods are admitted unchanged and the injection that would have been done is logged and returned as warnings.")
+	flag.StringVar(&parameters.Credentials.Secret, "credentials-secret", "", "Default Secret holding the 1Password CLI credentials added to the injected containers, which must exist in the namespaces of the injected pods. Disabled when empty.")
+	flag.StringVar(&credentialsType, "credentials-type", string(webhook.CredentialsServiceAccount), "Type of the credentials held by -credentials-secret: service-account or connect.")
+	flag.BoolVar(&protectInjection, "protect-injected-pods", false, "Deny the updates of injected pods changing their operator.1password.io/status annotation or the images of their injected init containers.")
+	flag.StringVar(&workloads, "workloads", "", "Also admit the pod templates of Deployments, StatefulSets, DaemonSets, Jobs and CronJobs: validate denies the workloads whose pods would be denied, mutate injects the secrets into their pod templates. Only pods are admitted when empty.")
+	flag.StringVar(&workloadTemplates, "workload-templates", "", "Comma separated <group>/<version>/<resource>=<path> pairs of additional workload resources admitted with -workloads, and the JSON pointer to their pod template, e.g. argoproj.io/v1alpha1/rollouts=/spec/template.")
+	flag.StringVar(&objectSelector, "object-selector", "secrets-injection notin (disabled)", "Label selector of the pods and workloads sent to the webhook, e.g. to keep system pods and high-churn jobs from depending on the injector. All the objects of the enabled namespaces are sent when empty.")
 	flag.Parse()
 
+	var err error
+	if parameters.CLIImage.Digests, err = webhook.ParseImageDigests(opImageDigests); err != nil {
+		glog.Errorf("Invalid -op-image-digests: %v", err)
+		os.Exit(1)
+	}
+	if parameters.CLIImage.PullPolicy, err = webhook.ParsePullPolicy(opImagePullPolicy); err != nil {
+		glog.Errorf("Invalid -op-image-pull-policy: %v", err)
+		os.Exit(1)
+	}
+	if parameters.InitContainerResources, err = webhook.ParseResources(initCPURequest, initMemoryRequest, initCPULimit, initMemoryLimit); err != nil {
+		glog.Errorf("Invalid init container resources: %v", err)
+		os.Exit(1)
+	}
+	if parameters.CredentialsPolicy, err = webhook.ParseCredentialsPolicy(credentialsPolicy); err != nil {
+		glog.Errorf("Invalid -credentials-policy: %v", err)
+		os.Exit(1)
+	}
+	if parameters.Credentials.Type, err = webhook.ParseCredentialsType(credentialsType); err != nil {
+		glog.Errorf("Invalid -credentials-type: %v", err)
+		os.Exit(1)
+	}
+	if parameters.Workloads, err = webhook.ParseWorkloadMode(workloads); err != nil {
+		glog.Errorf("Invalid -workloads: %v", err)
+		os.Exit(1)
+	}
+	if parameters.Workloads != webhook.WorkloadsDisabled {
+		customTemplates, err := webhook.ParseWorkloadTemplates(workloadTemplates)
+		if err != nil {
+			glog.Errorf("Invalid -workload-templates: %v", err)
+			os.Exit(1)
+		}
+		parameters.WorkloadTemplates = append(append([]webhook.WorkloadTemplate{}, webhook.DefaultWorkloadTemplates...), customTemplates...)
+	}
+	var webhookObjectSelector *metav1.LabelSelector
+	if objectSelector != "" {
+		if webhookObjectSelector, err = metav1.ParseToLabelSelector(objectSelector); err != nil {
+			glog.Errorf("Invalid -object-selector: %v", err)
+			os.Exit(1)
+		}
+		// dropped by the API server, unset not to update the webhook configuration on every start
+		if len(webhookObjectSelector.MatchLabels) == 0 {
+			webhookObjectSelector.MatchLabels = nil
+		}
+	}
+	if parameters.CLIImage.Checksums, err = webhook.ParseChecksums(opChecksums); err != nil {
+		glog.Errorf("Invalid -op-checksums: %v", err)
+		os.Exit(1)
+	}
+	if bundledOPImage != "" {
+		if bundledOPVersion == "" {
+			glog.Error("-bundled-op-image requires the OP_BUNDLED_VERSION environment variable")
+			os.Exit(1)
+		}
+		checksum, err := opbin.Checksum(bundledOPPath)
+		if err != nil {
+			glog.Errorf("Failed to compute the checksum of the bundled 1Password CLI: %v", err)
+			os.Exit(1)
+		}
+		parameters.CLIImage.Bundled = &webhook.BundledCLI{
+			Image:   bundledOPImage,
+			Path:    bundledOPPath,
+			Version: bundledOPVersion,
+			SHA256:  checksum,
+		}
+	}
+	for _, name := range strings.Split(opImagePullSecrets, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			parameters.CLIImage.PullSecrets = append(parameters.CLIImage.PullSecrets, name)
+		}
+	}
+
 	glog.Info("Starting webhook")
 
 	webhook.InitK8sClient()
 
+	stopNamespaces := make(chan struct{})
+	defer close(stopNamespaces)
+	namespaces, err := webhook.NewNamespaceLister(stopNamespaces)
+	if err != nil {
+		glog.Errorf("Failed to cache the namespaces: %v", err)
+		os.Exit(1)
+	}
+
 	dnsNames := []string{
 		webhookServiceName,
 		webhookServiceName + "." + webhookNamespace,
@@ -56,7 +190,7 @@ func main() {
 	}
 
 	// create or update the mutatingwebhookconfiguration
-	err = webhook.CreateOrUpdateMutatingWebhookConfiguration(caPEM, webhookServiceName, webhookNamespace)
+	err = webhook.CreateOrUpdateMutatingWebhookConfiguration(caPEM, webhookServiceName, webhookNamespace, parameters.WorkloadTemplates, webhookObjectSelector)
 	if err != nil {
 		glog.Errorf("Failed to create or update the mutating webhook configuration: %v", err)
 		os.Exit(1)
@@ -71,11 +205,39 @@ func main() {
 			},
 			ReadHeaderTimeout: 5 * time.Second,
 		},
+		CLIImage:               parameters.CLIImage,
+		InitContainerResources: parameters.InitContainerResources,
+		CredentialsPolicy:      parameters.CredentialsPolicy,
+		Credentials:            parameters.Credentials,
+		Audit:                  audit,
+		Namespaces:             namespaces,
+		ProtectInjection:       protectInjection,
+		Workloads:              parameters.Workloads,
+		WorkloadTemplates:      parameters.WorkloadTemplates,
+	}
+
+	if recordEvents {
+		stopEvents := make(chan struct{})
+		defer close(stopEvents)
+		secretInjector.EventRecorder = webhook.NewEventRecorder(stopEvents)
+	}
+
+	if opImageVolume {
+		secretInjector.ImageVolumes = webhook.ImageVolumesSupported(context.Background(), webhookNamespace, parameters.CLIImage)
+		if !secretInjector.ImageVolumes {
+			glog.Warning("Falling back to copying the 1Password CLI with an init container")
+		}
+	}
+
+	if resolveImageCommand {
+		secretInjector.Registry = registry.NewClient()
 	}
 
 	// define http server and server handler
 	mux := http.NewServeMux()
 	mux.HandleFunc("/inject", secretInjector.Serve)
+	// counters of the audited admissions
+	mux.Handle("/debug/vars", expvar.Handler())
 	secretInjector.Server.Handler = mux
 
 	// start webhook server in new routine
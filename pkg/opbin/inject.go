@@ -0,0 +1,53 @@
+package opbin
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Dotenv is a dotenv file rendered from a template that isn't stored in a file.
+type Dotenv struct {
+	Name     string
+	Template string
+}
+
+// InjectFiles renders every template of templatesDir, and every dotenv template, into outDir with the `op inject`
+// command of the OP CLI binary at op. The hidden entries of templatesDir, such as the `..data` directory
+// of a ConfigMap volume, are skipped.
+func InjectFiles(op, templatesDir, outDir string, dotenvs []Dotenv) error {
+	if templatesDir != "" {
+		entries, err := os.ReadDir(templatesDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			if err := inject(op, "", "--in-file", filepath.Join(templatesDir, entry.Name()), "--out-file", filepath.Join(outDir, entry.Name())); err != nil {
+				return fmt.Errorf("rendering %s: %w", entry.Name(), err)
+			}
+		}
+	}
+
+	for _, dotenv := range dotenvs {
+		if err := inject(op, dotenv.Template, "--out-file", filepath.Join(outDir, dotenv.Name)); err != nil {
+			return fmt.Errorf("rendering %s: %w", dotenv.Name, err)
+		}
+	}
+	return nil
+}
+
+// inject runs `op inject` with the given arguments, passing the template on the standard input when set.
+func inject(op, template string, args ...string) error {
+	cmd := exec.Command(op, append([]string{"inject", "--force", "--file-mode=0644"}, args...)...)
+	if template != "" {
+		cmd.Stdin = strings.NewReader(template)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
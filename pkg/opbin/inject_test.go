@@ -0,0 +1,65 @@
+package opbin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOP is an `op inject` stand-in rendering the templates in upper case.
+const fakeOP = `#!/bin/sh
+in=/dev/stdin
+while [ $# -gt 0 ]; do
+	case "$1" in
+		--in-file) in="$2"; shift ;;
+		--out-file) out="$2"; shift ;;
+	esac
+	shift
+done
+tr a-z A-Z < "$in" > "$out"
+`
+
+func TestInjectFiles(t *testing.T) {
+	dir := t.TempDir()
+	op := filepath.Join(dir, "op")
+	require.NoError(t, os.WriteFile(op, []byte(fakeOP), 0o755))
+
+	// laid out like a ConfigMap volume
+	templatesDir := filepath.Join(dir, "templates")
+	require.NoError(t, os.MkdirAll(filepath.Join(templatesDir, "..data"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(templatesDir, "..data", "application.yml"), []byte("password: {{ op://vault/item/password }}"), 0o644))
+	require.NoError(t, os.Symlink("..data/application.yml", filepath.Join(templatesDir, "application.yml")))
+
+	outDir := filepath.Join(dir, "secrets")
+	require.NoError(t, os.Mkdir(outDir, 0o755))
+
+	err := InjectFiles(op, templatesDir, outDir, []Dotenv{{Name: "app.env", Template: "DB_PASSWORD={{ op://vault/item/password }}\n"}})
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(outDir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"app.env", "application.yml"}, names)
+
+	content, err := os.ReadFile(filepath.Join(outDir, "application.yml"))
+	require.NoError(t, err)
+	assert.Equal(t, "PASSWORD: {{ OP://VAULT/ITEM/PASSWORD }}", string(content))
+	content, err = os.ReadFile(filepath.Join(outDir, "app.env"))
+	require.NoError(t, err)
+	assert.Equal(t, "DB_PASSWORD={{ OP://VAULT/ITEM/PASSWORD }}\n", string(content))
+}
+
+func TestInjectFilesFailure(t *testing.T) {
+	dir := t.TempDir()
+	op := filepath.Join(dir, "op")
+	require.NoError(t, os.WriteFile(op, []byte("#!/bin/sh\nexit 1\n"), 0o755))
+
+	err := InjectFiles(op, "", dir, []Dotenv{{Name: "app.env", Template: "DB_PASSWORD={{ op://vault/item/password }}\n"}})
+	assert.ErrorContains(t, err, "rendering app.env")
+}
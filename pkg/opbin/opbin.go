@@ -0,0 +1,64 @@
+// Package opbin runs the OP CLI binary bundled in the injector image: it copies the binary into the volume
+// shared with the injected containers, and renders the secret files with it.
+package opbin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Checksum returns the hex encoded SHA-256 checksum of the file.
+func Checksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Copy copies the executable at source to destination, after checking that its SHA-256 checksum is one of the allowed ones.
+// The binary is verified while it's copied and only moved in place once verified,
+// so a partially written or tampered binary is never left at destination.
+func Copy(source, destination string, allowedSHA256 []string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(destination), ".op-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		return fmt.Errorf("copying %s: %w", source, err)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if !slices.ContainsFunc(allowedSHA256, func(allowed string) bool { return strings.EqualFold(allowed, checksum) }) {
+		return fmt.Errorf("checksum mismatch for %s: got %s, expected one of %s", source, checksum, strings.Join(allowedSHA256, ", "))
+	}
+
+	if err := out.Chmod(0o755); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), destination)
+}
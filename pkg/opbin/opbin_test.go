@@ -0,0 +1,71 @@
+package opbin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "op")
+	require.NoError(t, os.WriteFile(source, []byte("op binary"), 0o644))
+	checksum, err := Checksum(source)
+	require.NoError(t, err)
+
+	const otherChecksum = "0000000000000000000000000000000000000000000000000000000000000000"
+
+	testCases := map[string]struct {
+		allowed []string
+		wantErr bool
+	}{
+		"matching checksum": {
+			allowed: []string{checksum},
+		},
+		"checksum is case insensitive": {
+			allowed: []string{strings.ToUpper(checksum)},
+		},
+		"one of the allowed checksums": {
+			allowed: []string{otherChecksum, checksum},
+		},
+		"mismatching checksum": {
+			allowed: []string{otherChecksum},
+			wantErr: true,
+		},
+		"no allowed checksum": {
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			destination := filepath.Join(t.TempDir(), "op")
+			err := Copy(source, destination, tc.allowed)
+			if tc.wantErr {
+				assert.ErrorContains(t, err, "checksum mismatch")
+				assert.NoFileExists(t, destination)
+				entries, err := os.ReadDir(filepath.Dir(destination))
+				require.NoError(t, err)
+				assert.Empty(t, entries)
+				return
+			}
+			require.NoError(t, err)
+
+			content, err := os.ReadFile(destination)
+			require.NoError(t, err)
+			assert.Equal(t, "op binary", string(content))
+			info, err := os.Stat(destination)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+		})
+	}
+}
+
+func TestCopyMissingSource(t *testing.T) {
+	err := Copy(filepath.Join(t.TempDir(), "op"), filepath.Join(t.TempDir(), "op"), nil)
+	assert.Error(t, err)
+}
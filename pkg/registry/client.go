@@ -0,0 +1,375 @@
+package registry
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mediaTypeOCIIndex          = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest       = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerList        = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest    = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerContentDigestHeader  = "Docker-Content-Digest"
+	maxRegistryResponseSize    = 4 << 20
+	defaultRegistryHTTPTimeout = 5 * time.Second
+	// maxCachedImageConfigs bounds the cache, the least recently used image configurations are evicted first.
+	maxCachedImageConfigs = 256
+)
+
+var manifestMediaTypes = strings.Join([]string{
+	mediaTypeOCIIndex,
+	mediaTypeDockerList,
+	mediaTypeOCIManifest,
+	mediaTypeDockerManifest,
+}, ", ")
+
+// ImageConfig holds the parts of an image configuration relevant to build a container command.
+type ImageConfig struct {
+	Entrypoint []string
+	Cmd        []string
+}
+
+// Platform selects the image of a multi-platform index.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+}
+
+// Client fetches image configurations from OCI/Docker registries using the registry HTTP API V2.
+// Image configurations are cached in memory by manifest digest, up to maxCachedImageConfigs of them.
+type Client struct {
+	HTTPClient *http.Client
+	Platform   Platform
+
+	mu    sync.Mutex
+	cache map[string]*list.Element
+	// recent orders the cache entries from the most to the least recently used.
+	recent *list.List
+}
+
+type cacheEntry struct {
+	digest string
+	config ImageConfig
+}
+
+// NewClient returns a Client that resolves images for linux on the architecture the injector runs on.
+func NewClient() *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: defaultRegistryHTTPTimeout},
+		Platform: Platform{
+			OS:           "linux",
+			Architecture: runtime.GOARCH,
+		},
+	}
+}
+
+type descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+	Config    descriptor   `json:"config"`
+}
+
+type imageConfigFile struct {
+	Config struct {
+		Entrypoint []string `json:"Entrypoint"`
+		Cmd        []string `json:"Cmd"`
+	} `json:"config"`
+}
+
+// ImageConfig returns the ENTRYPOINT and CMD of the given image, authenticating with the keychain when the registry requires it.
+func (c *Client) ImageConfig(ctx context.Context, image string, keychain Keychain) (*ImageConfig, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{client: c, ref: ref, creds: keychain[ref.Registry]}
+
+	digest := ref.Digest
+	if digest == "" {
+		digest, err = s.manifestDigest(ctx, ref.Tag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config, ok := c.cached(digest); ok {
+		return &config, nil
+	}
+
+	m, err := s.manifest(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Manifests) > 0 {
+		platformDigest, err := c.selectPlatform(m.Manifests)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ref, err)
+		}
+		m, err = s.manifest(ctx, platformDigest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m.Config.Digest == "" {
+		return nil, fmt.Errorf("%s: manifest does not reference an image config", ref)
+	}
+
+	body, err := s.get(ctx, "/blobs/"+m.Config.Digest, "")
+	if err != nil {
+		return nil, err
+	}
+	var configFile imageConfigFile
+	if err := json.Unmarshal(body, &configFile); err != nil {
+		return nil, fmt.Errorf("%s: could not parse image config: %w", ref, err)
+	}
+
+	config := ImageConfig{
+		Entrypoint: configFile.Config.Entrypoint,
+		Cmd:        configFile.Config.Cmd,
+	}
+	c.store(digest, config)
+	return &config, nil
+}
+
+func (c *Client) cached(digest string) (ImageConfig, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.cache[digest]
+	if !ok {
+		return ImageConfig{}, false
+	}
+	c.recent.MoveToFront(element)
+	return element.Value.(*cacheEntry).config, true
+}
+
+func (c *Client) store(digest string, config ImageConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = map[string]*list.Element{}
+		c.recent = list.New()
+	}
+	if element, ok := c.cache[digest]; ok {
+		element.Value.(*cacheEntry).config = config
+		c.recent.MoveToFront(element)
+		return
+	}
+	c.cache[digest] = c.recent.PushFront(&cacheEntry{digest: digest, config: config})
+	if c.recent.Len() > maxCachedImageConfigs {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.cache, oldest.Value.(*cacheEntry).digest)
+	}
+}
+
+func (c *Client) selectPlatform(manifests []descriptor) (string, error) {
+	for _, m := range manifests {
+		if m.Platform != nil && m.Platform.OS == c.Platform.OS && m.Platform.Architecture == c.Platform.Architecture {
+			return m.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("no image found for platform %s/%s", c.Platform.OS, c.Platform.Architecture)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// session holds the state of the requests made to a registry for a single image.
+type session struct {
+	client *Client
+	ref    Reference
+	creds  Credentials
+	// authorization is the Authorization header value obtained after the registry challenged the first request.
+	authorization string
+}
+
+func (s *session) manifestDigest(ctx context.Context, tag string) (string, error) {
+	resp, err := s.do(ctx, http.MethodHead, "/manifests/"+tag, manifestMediaTypes)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if digest := resp.Header.Get(dockerContentDigestHeader); digest != "" {
+		return digest, nil
+	}
+
+	// Not every registry returns the digest header, in that case compute it from the manifest itself.
+	body, err := s.get(ctx, "/manifests/"+tag, manifestMediaTypes)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+func (s *session) manifest(ctx context.Context, digest string) (*manifest, error) {
+	body, err := s.get(ctx, "/manifests/"+digest, manifestMediaTypes)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("%s: could not parse manifest: %w", s.ref, err)
+	}
+	return &m, nil
+}
+
+func (s *session) get(ctx context.Context, path, accept string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, path, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRegistryResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not read response: %w", s.ref, err)
+	}
+	return body, nil
+}
+
+// do sends a request to the repository API, authenticating once if the registry responds with a challenge.
+func (s *session) do(ctx context.Context, method, path, accept string) (*http.Response, error) {
+	endpoint := fmt.Sprintf("%s://%s/v2/%s%s", scheme(s.ref.apiHost()), s.ref.apiHost(), s.ref.Repository, path)
+
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if s.authorization != "" {
+			req.Header.Set("Authorization", s.authorization)
+		}
+		return s.client.httpClient().Do(req)
+	}
+
+	resp, err := send()
+	if err != nil {
+		return nil, fmt.Errorf("%s: request to registry failed: %w", s.ref, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized && s.authorization == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := s.authenticate(ctx, challenge); err != nil {
+			return nil, err
+		}
+		resp, err = send()
+		if err != nil {
+			return nil, fmt.Errorf("%s: request to registry failed: %w", s.ref, err)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: registry responded to %s %s with %s", s.ref, method, path, resp.Status)
+	}
+	return resp, nil
+}
+
+// authenticate handles the Basic and Bearer challenges described by the distribution token authentication spec.
+func (s *session) authenticate(ctx context.Context, challenge string) error {
+	authScheme, params := parseChallenge(challenge)
+	switch strings.ToLower(authScheme) {
+	case "basic":
+		if s.creds.Username == "" {
+			return fmt.Errorf("%s: registry requires credentials, but no image pull secret provides them", s.ref)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(s.creds.Username, s.creds.Password)
+		s.authorization = req.Header.Get("Authorization")
+		return nil
+	case "bearer":
+		realm := params["realm"]
+		if realm == "" {
+			return fmt.Errorf("%s: registry bearer challenge has no realm", s.ref)
+		}
+		query := url.Values{}
+		if service := params["service"]; service != "" {
+			query.Set("service", service)
+		}
+		query.Set("scope", fmt.Sprintf("repository:%s:pull", s.ref.Repository))
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+query.Encode(), nil)
+		if err != nil {
+			return fmt.Errorf("%s: invalid token realm: %w", s.ref, err)
+		}
+		if s.creds.Username != "" {
+			req.SetBasicAuth(s.creds.Username, s.creds.Password)
+		}
+		resp, err := s.client.httpClient().Do(req)
+		if err != nil {
+			return fmt.Errorf("%s: token request failed: %w", s.ref, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: token request responded with %s", s.ref, resp.Status)
+		}
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxRegistryResponseSize)).Decode(&token); err != nil {
+			return fmt.Errorf("%s: could not parse token response: %w", s.ref, err)
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		s.authorization = "Bearer " + token.Token
+		return nil
+	default:
+		return fmt.Errorf("%s: unsupported registry authentication challenge %q", s.ref, challenge)
+	}
+}
+
+// parseChallenge parses a WWW-Authenticate header such as `Bearer realm="...",service="..."`.
+func parseChallenge(challenge string) (string, map[string]string) {
+	authScheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+	for _, param := range strings.Split(rest, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			continue
+		}
+		params[strings.ToLower(key)] = strings.Trim(value, `"`)
+	}
+	return authScheme, params
+}
+
+// scheme returns http for registries running on the loopback interface, as Docker does, and https otherwise.
+func scheme(host string) string {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" {
+		return "http"
+	}
+	if ip := net.ParseIP(hostname); ip != nil && ip.IsLoopback() {
+		return "http"
+	}
+	return "https"
+}
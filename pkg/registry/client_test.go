@@ -0,0 +1,165 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeRegistry is a minimal registry API V2 stand-in serving a single multi-platform image
+// that requires bearer token authentication.
+type fakeRegistry struct {
+	server       *httptest.Server
+	username     string
+	password     string
+	blobRequests atomic.Int32
+}
+
+func digestOf(t *testing.T, v interface{}) (string, []byte) {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), data
+}
+
+func newFakeRegistry(t *testing.T, repository string, config imageConfigFile) *fakeRegistry {
+	r := &fakeRegistry{username: "user", password: "pass"}
+
+	configDigest, configData := digestOf(t, config)
+	imageDigest, imageData := digestOf(t, manifest{
+		MediaType: mediaTypeOCIManifest,
+		Config:    descriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: configDigest},
+	})
+	indexDigest, indexData := digestOf(t, manifest{
+		MediaType: mediaTypeOCIIndex,
+		Manifests: []descriptor{
+			{MediaType: mediaTypeOCIManifest, Digest: "sha256:other", Platform: &Platform{OS: "windows", Architecture: "amd64"}},
+			{MediaType: mediaTypeOCIManifest, Digest: imageDigest, Platform: &Platform{OS: "linux", Architecture: "amd64"}},
+		},
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		if !ok || username != r.username || password != r.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, "repository:"+repository+":pull", req.URL.Query().Get("scope"))
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "secret-token"})
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+r.server.URL+`/token",service="fake"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimPrefix(req.URL.Path, "/v2/"+repository)
+		var body []byte
+		switch path {
+		case "/manifests/1.0", "/manifests/" + indexDigest:
+			w.Header().Set(dockerContentDigestHeader, indexDigest)
+			body = indexData
+		case "/manifests/" + imageDigest:
+			body = imageData
+		case "/blobs/" + configDigest:
+			r.blobRequests.Add(1)
+			body = configData
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(body)
+		}
+	})
+	r.server = httptest.NewServer(mux)
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func TestImageConfig(t *testing.T) {
+	var config imageConfigFile
+	config.Config.Entrypoint = []string{"/docker-entrypoint.sh"}
+	config.Config.Cmd = []string{"nginx", "-g", "daemon off;"}
+	registry := newFakeRegistry(t, "team/app", config)
+
+	client := NewClient()
+	client.Platform = Platform{OS: "linux", Architecture: "amd64"}
+	keychain := Keychain{registry.host(): {Username: "user", Password: "pass"}}
+
+	for i := 0; i < 2; i++ {
+		imageConfig, err := client.ImageConfig(context.Background(), registry.host()+"/team/app:1.0", keychain)
+		require.NoError(t, err)
+		assert.Equal(t, config.Config.Entrypoint, imageConfig.Entrypoint)
+		assert.Equal(t, config.Config.Cmd, imageConfig.Cmd)
+	}
+	assert.Equal(t, int32(1), registry.blobRequests.Load(), "image config should be served from the cache")
+}
+
+func TestImageConfigCacheIsBounded(t *testing.T) {
+	client := NewClient()
+	for i := 0; i <= maxCachedImageConfigs; i++ {
+		client.store(fmt.Sprintf("sha256:%064d", i), ImageConfig{Cmd: []string{fmt.Sprint(i)}})
+		// keep the first image configuration in use
+		_, ok := client.cached(fmt.Sprintf("sha256:%064d", 0))
+		require.True(t, ok)
+	}
+
+	assert.Len(t, client.cache, maxCachedImageConfigs)
+	_, ok := client.cached(fmt.Sprintf("sha256:%064d", 0))
+	assert.True(t, ok, "the recently used image config should be kept")
+	_, ok = client.cached(fmt.Sprintf("sha256:%064d", 1))
+	assert.False(t, ok, "the least recently used image config should be evicted")
+}
+
+func TestImageConfigWithoutCredentials(t *testing.T) {
+	registry := newFakeRegistry(t, "team/app", imageConfigFile{})
+
+	_, err := NewClient().ImageConfig(context.Background(), registry.host()+"/team/app:1.0", Keychain{})
+	assert.Error(t, err)
+}
+
+func TestImageConfigUnknownPlatform(t *testing.T) {
+	registry := newFakeRegistry(t, "team/app", imageConfigFile{})
+
+	client := NewClient()
+	client.Platform = Platform{OS: "linux", Architecture: "s390x"}
+	_, err := client.ImageConfig(context.Background(), registry.host()+"/team/app:1.0",
+		Keychain{registry.host(): {Username: "user", Password: "pass"}})
+	assert.ErrorContains(t, err, "no image found for platform linux/s390x")
+}
+
+func TestKeychainAddPullSecret(t *testing.T) {
+	keychain := Keychain{}
+	err := keychain.AddPullSecret(&corev1.Secret{
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{
+				"https://index.docker.io/v1/":{"auth":"dXNlcjpwYXNz"},
+				"ghcr.io":{"username":"gh","password":"token"}
+			}}`),
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Credentials{Username: "user", Password: "pass"}, keychain["docker.io"])
+	assert.Equal(t, Credentials{Username: "gh", Password: "token"}, keychain["ghcr.io"])
+
+	err = keychain.AddPullSecret(&corev1.Secret{Type: corev1.SecretTypeOpaque})
+	assert.Error(t, err)
+}
@@ -0,0 +1,71 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Credentials used to authenticate against a registry.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Keychain maps a registry (as used in Reference.Registry) to its credentials.
+type Keychain map[string]Credentials
+
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// AddPullSecret adds the credentials found in an image pull secret
+// (of type kubernetes.io/dockerconfigjson or kubernetes.io/dockercfg) to the keychain.
+// Credentials already in the keychain take precedence, matching the order of the pod's imagePullSecrets.
+func (k Keychain) AddPullSecret(secret *corev1.Secret) error {
+	var auths map[string]dockerConfigEntry
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		var config dockerConfigJSON
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return fmt.Errorf("could not parse image pull secret %s: %w", secret.Name, err)
+		}
+		auths = config.Auths
+	case corev1.SecretTypeDockercfg:
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			return fmt.Errorf("could not parse image pull secret %s: %w", secret.Name, err)
+		}
+	default:
+		return fmt.Errorf("image pull secret %s has unsupported type %s", secret.Name, secret.Type)
+	}
+
+	for host, entry := range auths {
+		creds := Credentials{Username: entry.Username, Password: entry.Password}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return fmt.Errorf("could not decode auth for %s in image pull secret %s: %w", host, secret.Name, err)
+			}
+			username, password, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return fmt.Errorf("invalid auth for %s in image pull secret %s", host, secret.Name)
+			}
+			creds = Credentials{Username: username, Password: password}
+		}
+
+		registry := normalizeRegistryHost(host)
+		if _, exists := k[registry]; !exists {
+			k[registry] = creds
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// dockerHubRegistry is the registry used for images that do not specify one.
+	dockerHubRegistry = "docker.io"
+	// dockerHubAPIHost is the host serving the registry API for Docker Hub.
+	dockerHubAPIHost = "registry-1.docker.io"
+
+	defaultTag = "latest"
+)
+
+// Reference is a parsed container image reference.
+type Reference struct {
+	Registry   string // e.g. docker.io, ghcr.io, localhost:5000
+	Repository string // e.g. library/nginx
+	Tag        string
+	Digest     string // e.g. sha256:...
+}
+
+// ParseReference parses an image reference as found in a container spec
+// (e.g. `nginx`, `ghcr.io/org/app:1.0`, `app@sha256:...`) following Docker's normalization rules.
+func ParseReference(image string) (Reference, error) {
+	var ref Reference
+	if image == "" {
+		return ref, fmt.Errorf("empty image reference")
+	}
+
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+		if !strings.Contains(ref.Digest, ":") {
+			return ref, fmt.Errorf("invalid digest in image reference %q", image)
+		}
+	}
+
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i:], "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+	}
+
+	ref.Registry = dockerHubRegistry
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			ref.Registry = first
+			name = name[i+1:]
+		}
+	}
+	if ref.Registry == dockerHubRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" {
+		return ref, fmt.Errorf("invalid image reference %q", image)
+	}
+	ref.Repository = name
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+	return ref, nil
+}
+
+// Identifier returns the digest of the reference if set, the tag otherwise.
+func (r Reference) Identifier() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// String returns the fully qualified image reference.
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// apiHost returns the host serving the registry API for the reference.
+func (r Reference) apiHost() string {
+	if r.Registry == dockerHubRegistry {
+		return dockerHubAPIHost
+	}
+	return r.Registry
+}
+
+// normalizeRegistryHost maps the different spellings of a registry, as found in docker config files,
+// to the registry name used in a Reference.
+func normalizeRegistryHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	switch host {
+	case "index.docker.io", dockerHubAPIHost:
+		return dockerHubRegistry
+	}
+	return host
+}
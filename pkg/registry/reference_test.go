@@ -0,0 +1,52 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReference(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected Reference
+	}{
+		"docker hub official image": {
+			input:    "nginx",
+			expected: Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "latest"},
+		},
+		"docker hub image with tag": {
+			input:    "1password/op:2",
+			expected: Reference{Registry: "docker.io", Repository: "1password/op", Tag: "2"},
+		},
+		"registry with port": {
+			input:    "localhost:5000/team/app:1.0",
+			expected: Reference{Registry: "localhost:5000", Repository: "team/app", Tag: "1.0"},
+		},
+		"registry with digest": {
+			input:    "ghcr.io/org/app@sha256:abc",
+			expected: Reference{Registry: "ghcr.io", Repository: "org/app", Digest: "sha256:abc"},
+		},
+		"tag and digest": {
+			input:    "ghcr.io/org/app:1.0@sha256:abc",
+			expected: Reference{Registry: "ghcr.io", Repository: "org/app", Tag: "1.0", Digest: "sha256:abc"},
+		},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			ref, err := ParseReference(tc.input)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, ref)
+		})
+	}
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+	for _, input := range []string{"", "app@abc"} {
+		_, err := ParseReference(input)
+		assert.Error(t, err, input)
+	}
+}
@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+
+	"github.com/golang/glog"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// injectionNamespaceLabel enables the injection for the pods of the labeled namespaces.
+	injectionNamespaceLabel = "secrets-injection"
+	// injectionEnabled enforces the injection in the namespace.
+	injectionEnabled = "enabled"
+	// injectionAudit audits the injection in the namespace: the pods are admitted unchanged,
+	// the injection that would have been done is only logged and reported.
+	injectionAudit = "audit"
+
+	reasonAudited = "SecretsInjectionAudited"
+
+	auditOutcomePatched   = "patched"
+	auditOutcomeDenied    = "denied"
+	auditOutcomeUnchanged = "unchanged"
+)
+
+// auditOutcomes counts the audited admissions by outcome, exposed with expvar.
+var auditOutcomes = expvar.NewMap("secrets_injector_audit")
+
+type auditContextKey struct{}
+
+// withAudit marks the admission of the context as audited.
+func withAudit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, auditContextKey{}, true)
+}
+
+// isAudit reports whether the admission of the context is audited.
+func isAudit(ctx context.Context) bool {
+	audit, _ := ctx.Value(auditContextKey{}).(bool)
+	return audit
+}
+
+// auditMode reports whether the injection is audited instead of enforced,
+// either for the whole cluster or for the namespace, labeled with secrets-injection=audit.
+func (s *SecretInjector) auditMode(namespace *corev1.Namespace) bool {
+	return s.Audit || (namespace != nil && namespace.Labels[injectionNamespaceLabel] == injectionAudit)
+}
+
+// auditResponse turns the response of an audited admission into one admitting the pod unchanged.
+// The patch that would have been applied is logged operation by operation, and the patch or the denial
+// that would have happened is returned as a warning.
+func auditResponse(pod *corev1.Pod, response *admissionv1.AdmissionResponse) *admissionv1.AdmissionResponse {
+	switch {
+	case len(response.Patch) > 0:
+		var operations []patchOperation
+		if err := json.Unmarshal(response.Patch, &operations); err != nil {
+			glog.Errorf("Could not unmarshal the audited patch of %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+		for _, op := range operations {
+			value, _ := json.Marshal(op.Value)
+			glog.Infof("Audit: secret injection would %s %s of pod %s/%s: %s", op.Op, op.Path, pod.Namespace, pod.Name, value)
+		}
+		auditOutcomes.Add(auditOutcomePatched, 1)
+		response.Warnings = append(response.Warnings, fmt.Sprintf("audit mode: the secret injection would apply %d patch operation(s) to the pod, listed in the injector logs", len(operations)))
+		response.Patch = nil
+		response.PatchType = nil
+	case !response.Allowed:
+		message := ""
+		if response.Result != nil {
+			message = response.Result.Message
+		}
+		glog.Infof("Audit: secret injection would deny pod %s/%s: %s", pod.Namespace, pod.Name, message)
+		auditOutcomes.Add(auditOutcomeDenied, 1)
+		response.Warnings = append(response.Warnings, fmt.Sprintf("audit mode: the secret injection would deny the pod: %s", message))
+		response.Allowed = true
+		response.Result = nil
+	default:
+		auditOutcomes.Add(auditOutcomeUnchanged, 1)
+	}
+	return response
+}
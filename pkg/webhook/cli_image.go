@@ -0,0 +1,212 @@
+package webhook
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// defaultOpCLIRepository is the repository of the OP CLI image on Docker Hub.
+	defaultOpCLIRepository = "1password/op"
+	// opCLIImageBinDir is the directory of the OP CLI binary in the OP CLI image, relative to the image root.
+	opCLIImageBinDir = "usr/local/bin"
+)
+
+var (
+	// digestPattern is the format of a pinned image digest.
+	digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	// checksumPattern is the format of a hex encoded SHA-256 checksum.
+	checksumPattern = regexp.MustCompile(`^[a-f0-9]{64}$`)
+)
+
+// CLIImage configures the OP CLI image used by the injected init containers.
+// The zero value pulls 1password/op from Docker Hub.
+type CLIImage struct {
+	Registry   string            // registry host the image is pulled from, Docker Hub when empty
+	Repository string            // image repository, 1password/op when empty
+	Digests    map[string]string // pinned image digest by OP CLI version
+	PullPolicy corev1.PullPolicy // IfNotPresent when empty
+	// PullSecrets are the image pull secrets added to the mutated pods. They must exist in the pods' namespaces.
+	PullSecrets []string
+	// Checksums are the SHA-256 checksums of the OP CLI binary allowed by OP CLI version, e.g. one per architecture.
+	// The binary of a version with checksums is verified before being exposed to the injected containers.
+	Checksums map[string][]string
+	// Bundled is the OP CLI shipped in the injector image. When set, it's used instead of the OP CLI image
+	// for the versions it provides.
+	Bundled *BundledCLI
+}
+
+// BundledCLI is an OP CLI binary shipped in the injector image, copied by the injector itself.
+// The copy doesn't need a shell and verifies the checksum of the binary.
+type BundledCLI struct {
+	Image   string // the injector image
+	Path    string // path of the OP CLI binary in the injector image
+	Version string // version of the OP CLI binary, e.g. 2.30.0
+	SHA256  string // hex encoded checksum of the OP CLI binary
+}
+
+// provides reports whether the bundled OP CLI satisfies the requested version,
+// which is an image tag such as 2, 2.30 or 2.30.0.
+func (b *BundledCLI) provides(version string) bool {
+	return version == b.Version || strings.HasPrefix(b.Version, version+".")
+}
+
+// image returns the image of the given OP CLI version, pinned to its digest when one is configured.
+func (ci *CLIImage) image(version string) string {
+	repository := ci.Repository
+	if repository == "" {
+		repository = defaultOpCLIRepository
+	}
+	if ci.Registry != "" {
+		repository = strings.TrimSuffix(ci.Registry, "/") + "/" + repository
+	}
+
+	image := repository + ":" + version
+	if digest, ok := ci.Digests[version]; ok {
+		image += "@" + digest
+	}
+	return image
+}
+
+// reference returns the image holding the given OP CLI version:
+// the injector image when it bundles that version, the OP CLI image otherwise.
+func (ci *CLIImage) reference(version string) string {
+	if ci.Bundled != nil && ci.Bundled.provides(version) {
+		return ci.Bundled.Image
+	}
+	return ci.image(version)
+}
+
+// binDir returns the directory of the OP CLI binary in the image, relative to the image root.
+func (ci *CLIImage) binDir(reference string) string {
+	if ci.Bundled != nil && reference == ci.Bundled.Image {
+		return strings.TrimPrefix(path.Dir(ci.Bundled.Path), "/")
+	}
+	return opCLIImageBinDir
+}
+
+// verifies reports whether the binary of the given OP CLI version is verified against an allow-list of checksums.
+// Only copied binaries can be verified, so such versions are never mounted from an image volume.
+func (ci *CLIImage) verifies(version string) bool {
+	return len(ci.Checksums[version]) > 0
+}
+
+// copyScript returns the shell script copying the OP CLI binary from the OP CLI image into binVolume.
+// When the version has an allow-list of checksums, the copy is verified before being moved in place.
+func (ci *CLIImage) copyScript(version string) string {
+	if !ci.verifies(version) {
+		return fmt.Sprintf("cp /usr/local/bin/op %s", binVolumeMountPath)
+	}
+
+	tmp := binVolumeMountPath + ".op"
+	return strings.Join([]string{
+		"set -e",
+		fmt.Sprintf("cp /usr/local/bin/op %s", tmp),
+		fmt.Sprintf(`checksum="$(sha256sum %s | cut -d ' ' -f 1)"`, tmp),
+		`case "$checksum" in`,
+		fmt.Sprintf("%s) mv %s %sop ;;", strings.Join(ci.Checksums[version], "|"), tmp, binVolumeMountPath),
+		fmt.Sprintf(`*) rm -f %s; echo "the checksum $checksum of the 1Password CLI %s binary is not allowed" >&2; exit 1 ;;`, tmp, version),
+		"esac",
+	}, "\n")
+}
+
+// binImageVolume returns the image volume mounting the image holding the given OP CLI version,
+// which replaces the in-memory copy of the binary made by the copy-op-bin init container.
+func (ci *CLIImage) binImageVolume(name, version string) corev1.Volume {
+	return corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			Image: &corev1.ImageVolumeSource{
+				Reference:  ci.reference(version),
+				PullPolicy: ci.pullPolicy(),
+			},
+		},
+	}
+}
+
+func (ci *CLIImage) pullPolicy() corev1.PullPolicy {
+	if ci.PullPolicy == "" {
+		return corev1.PullIfNotPresent
+	}
+	return ci.PullPolicy
+}
+
+// ParseImageDigests parses a comma separated list of `<version>=<digest>` pairs.
+func ParseImageDigests(value string) (map[string]string, error) {
+	digests := map[string]string{}
+	for _, pair := range parseList(value) {
+		version, digest, ok := strings.Cut(pair, "=")
+		version, digest = strings.TrimSpace(version), strings.TrimSpace(digest)
+		if !ok || !imageTagPattern.MatchString(version) {
+			return nil, fmt.Errorf("invalid image digest %q, expected <version>=sha256:<hex>", pair)
+		}
+		if !digestPattern.MatchString(digest) {
+			return nil, fmt.Errorf("invalid image digest %q for version %s", digest, version)
+		}
+		digests[version] = digest
+	}
+	return digests, nil
+}
+
+// ParseChecksums parses a comma separated list of `<version>=<sha256>` pairs.
+// A version can be listed several times to allow several checksums, e.g. one per architecture.
+func ParseChecksums(value string) (map[string][]string, error) {
+	checksums := map[string][]string{}
+	for _, pair := range parseList(value) {
+		version, checksum, ok := strings.Cut(pair, "=")
+		version, checksum = strings.TrimSpace(version), strings.ToLower(strings.TrimSpace(checksum))
+		if !ok || !imageTagPattern.MatchString(version) {
+			return nil, fmt.Errorf("invalid checksum %q, expected <version>=<sha256>", pair)
+		}
+		if !checksumPattern.MatchString(checksum) {
+			return nil, fmt.Errorf("invalid SHA-256 checksum %q for version %s", checksum, version)
+		}
+		checksums[version] = append(checksums[version], checksum)
+	}
+	return checksums, nil
+}
+
+// ParsePullPolicy validates an image pull policy, IfNotPresent being the default.
+func ParsePullPolicy(value string) (corev1.PullPolicy, error) {
+	switch policy := corev1.PullPolicy(value); policy {
+	case "":
+		return corev1.PullIfNotPresent, nil
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid image pull policy %q", value)
+	}
+}
+
+// addImagePullSecrets adds the configured pull secrets missing from the pod.
+func (ci *CLIImage) addImagePullSecrets(pod *corev1.Pod) (patch []patchOperation) {
+	existing := map[string]struct{}{}
+	for _, secret := range pod.Spec.ImagePullSecrets {
+		existing[secret.Name] = struct{}{}
+	}
+	first := len(pod.Spec.ImagePullSecrets) == 0
+	for _, name := range ci.PullSecrets {
+		if _, ok := existing[name]; ok {
+			continue
+		}
+		existing[name] = struct{}{}
+
+		var value interface{} = corev1.LocalObjectReference{Name: name}
+		path := "/spec/imagePullSecrets/-"
+		if first {
+			first = false
+			value = []corev1.LocalObjectReference{{Name: name}}
+			path = "/spec/imagePullSecrets"
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
+	return patch
+}
@@ -0,0 +1,150 @@
+package webhook
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// accountAnnotation is the 1Password account `op run` uses, passed with --account.
+	accountAnnotation = "operator.1password.io/account"
+	// noMaskingAnnotation disables the masking of secrets in the output of `op run`, with --no-masking.
+	noMaskingAnnotation = "operator.1password.io/no-masking"
+)
+
+// imageTagPattern is the format of an image tag, as defined by the OCI distribution spec.
+var imageTagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// containerAnnotation returns the value of the annotation for the given container.
+// `<annotation>.<container>` applies to that container only and overrides `<annotation>`, which applies to the whole pod.
+func containerAnnotation(annotations map[string]string, annotation, container string) (string, bool) {
+	if value, ok := annotations[annotation+"."+container]; ok {
+		return value, true
+	}
+	value, ok := annotations[annotation]
+	return value, ok
+}
+
+// cliVersion returns the OP CLI version the container runs.
+func (c *injectionConfig) cliVersion(container string) (string, error) {
+	version, ok := c.annotations[versionAnnotation+"."+container]
+	if !ok {
+		return c.version, nil
+	}
+	return parseCLIVersion(version)
+}
+
+// parseCLIVersion validates an OP CLI version, which is used as the tag of the OP CLI image.
+func parseCLIVersion(value string) (string, error) {
+	version := strings.TrimSpace(value)
+	if !imageTagPattern.MatchString(version) {
+		return "", fmt.Errorf("invalid OP CLI version %q", value)
+	}
+	return version, nil
+}
+
+// checkCLIVersions validates the OP CLI versions of the containers, whose volumes and init containers are named
+// after them: the names must be valid, and distinct versions must not be given the same names, e.g. 2.30 and 2-30.
+func checkCLIVersions(annotations map[string]string, podVersion string) error {
+	var keys []string
+	for key := range annotations {
+		if strings.HasPrefix(key, versionAnnotation+".") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	versions := map[string]string{}
+	for _, key := range keys {
+		version, err := parseCLIVersion(annotations[key])
+		if err != nil {
+			return err
+		}
+		if version == podVersion {
+			continue
+		}
+		// the init container name is the longest of the names
+		name := binInitContainerName + "-" + versionSuffix(version)
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return fmt.Errorf("invalid %s %q: the init container copying it can't be named %s: %s", key, version, name, strings.Join(errs, ", "))
+		}
+		if other, ok := versions[name]; ok && other != version {
+			return fmt.Errorf("invalid %s %q: its init container would have the same name, %s, as the one of version %q", key, version, name, other)
+		}
+		versions[name] = version
+	}
+	return nil
+}
+
+// runOptions returns the `op run` options requested for the container.
+func (c *injectionConfig) runOptions(container string) ([]string, error) {
+	var options []string
+	if account, ok := containerAnnotation(c.annotations, accountAnnotation, container); ok && strings.TrimSpace(account) != "" {
+		options = append(options, "--account="+strings.TrimSpace(account))
+	}
+	if value, ok := containerAnnotation(c.annotations, noMaskingAnnotation, container); ok {
+		noMasking, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q for container %s", noMaskingAnnotation, value, container)
+		}
+		if noMasking {
+			options = append(options, "--no-masking")
+		}
+	}
+	return options, nil
+}
+
+// useCLIVersion records that a container runs the given OP CLI version and returns the mount of its binary.
+// The pod version lives in binVolume, every other version gets a volume, and a copy init container, of its own.
+func (c *injectionConfig) useCLIVersion(version string) corev1.VolumeMount {
+	found := false
+	for _, v := range c.cliVersions {
+		if v == version {
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.cliVersions = append(c.cliVersions, version)
+	}
+
+	mount := binVolumeMount
+	mount.Name = c.binVolumeName(version)
+	return mount
+}
+
+// binVolumeName returns the name of the volume holding the binary of the given OP CLI version.
+func (c *injectionConfig) binVolumeName(version string) string {
+	if version == c.version {
+		return binVolumeName
+	}
+	return binVolumeName + "-" + versionSuffix(version)
+}
+
+// binInitContainerName returns the name of the init container copying the binary of the given OP CLI version.
+func (c *injectionConfig) binInitContainerName(version string) string {
+	if version == c.version {
+		return binInitContainerName
+	}
+	return binInitContainerName + "-" + versionSuffix(version)
+}
+
+// versionSuffix turns an OP CLI version into a suffix valid in volume and container names, e.g. 2.24.0 into 2-24-0.
+func versionSuffix(version string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		default:
+			return '-'
+		}
+	}, version), "-")
+}
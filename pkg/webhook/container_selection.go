@@ -0,0 +1,94 @@
+package webhook
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// injectExcludeAnnotation lists the containers that must not be injected, even if selected by injectAnnotation.
+	injectExcludeAnnotation = "operator.1password.io/inject-exclude"
+
+	// injectAllContainers selects all the containers and init containers of the pod.
+	injectAllContainers = "*"
+	// injectAutoContainers selects the containers with at least one secret reference in their environment.
+	injectAutoContainers = "auto"
+
+	secretReferencePrefix = "op://"
+)
+
+// containerSelector decides which containers of a pod are injected, based on the pod annotations.
+type containerSelector struct {
+	all      bool
+	auto     bool
+	names    map[string]struct{}
+	excluded map[string]struct{}
+}
+
+// newContainerSelector parses the comma separated values of the inject and inject-exclude annotations.
+func newContainerSelector(inject, exclude string) containerSelector {
+	selector := containerSelector{
+		names:    map[string]struct{}{},
+		excluded: map[string]struct{}{},
+	}
+	for _, name := range parseList(inject) {
+		switch strings.ToLower(name) {
+		case injectAllContainers:
+			selector.all = true
+		case injectAutoContainers:
+			selector.auto = true
+		default:
+			selector.names[name] = struct{}{}
+		}
+	}
+	for _, name := range parseList(exclude) {
+		selector.excluded[name] = struct{}{}
+	}
+	return selector
+}
+
+// isEmpty reports whether the selector can't select any container.
+func (cs containerSelector) isEmpty() bool {
+	return !cs.all && !cs.auto && len(cs.names) == 0
+}
+
+// selects reports whether secrets must be injected into the container.
+// The init containers added by a previous injection are never selected, e.g. by `*`.
+func (cs containerSelector) selects(container *corev1.Container) bool {
+	if isInjectedInitContainer(container.Name) {
+		return false
+	}
+	if _, excluded := cs.excluded[container.Name]; excluded {
+		return false
+	}
+	if cs.all {
+		return true
+	}
+	if _, ok := cs.names[container.Name]; ok {
+		return true
+	}
+	return cs.auto && hasSecretReferences(container)
+}
+
+// hasSecretReferences reports whether an environment variable of the container references a 1Password secret.
+func hasSecretReferences(container *corev1.Container) bool {
+	for _, envVar := range container.Env {
+		if strings.HasPrefix(strings.TrimSpace(envVar.Value), secretReferencePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseList splits a comma separated annotation value, ignoring whitespace and empty entries.
+func parseList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
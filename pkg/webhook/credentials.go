@@ -0,0 +1,192 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// credentialsSecretAnnotation names the Secret holding the OP CLI credentials added to the injected containers.
+	credentialsSecretAnnotation = "operator.1password.io/credentials-secret"
+	// credentialsTypeAnnotation is the type of the credentials held by the credentials Secret.
+	credentialsTypeAnnotation = "operator.1password.io/credentials-type"
+
+	// keys of the credentials in the credentials Secret
+	credentialsHostKey  = "host"
+	credentialsTokenKey = "token"
+)
+
+// CredentialsType is the type of the OP CLI credentials held by a credentials Secret.
+type CredentialsType string
+
+const (
+	// CredentialsServiceAccount is a Service Account token, in the token key.
+	CredentialsServiceAccount CredentialsType = "service-account"
+	// CredentialsConnect is a Connect server, whose URL is in the host key and token in the token key.
+	CredentialsConnect CredentialsType = "connect"
+)
+
+// ParseCredentialsType validates a credentials type, service-account being the default.
+func ParseCredentialsType(value string) (CredentialsType, error) {
+	switch credentialsType := CredentialsType(strings.ToLower(strings.TrimSpace(value))); credentialsType {
+	case "":
+		return CredentialsServiceAccount, nil
+	case CredentialsServiceAccount, CredentialsConnect:
+		return credentialsType, nil
+	default:
+		return "", fmt.Errorf("invalid credentials type %q, expected %q or %q", value, CredentialsServiceAccount, CredentialsConnect)
+	}
+}
+
+// Credentials reference the Secret holding the OP CLI credentials of the injected containers.
+// The Secret must exist in the namespaces of the injected pods.
+type Credentials struct {
+	Secret string
+	Type   CredentialsType
+}
+
+// annotations returns the pod annotations referencing the credentials, used as defaults of the pods' annotations.
+func (c Credentials) annotations() map[string]string {
+	if c.Secret == "" {
+		return nil
+	}
+	return map[string]string{
+		credentialsSecretAnnotation: c.Secret,
+		credentialsTypeAnnotation:   string(c.Type),
+	}
+}
+
+// newCredentials reads the credentials Secret referenced by the pod annotations, if any.
+func newCredentials(annotations map[string]string) (*Credentials, error) {
+	secret, ok := annotations[credentialsSecretAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	secret = strings.TrimSpace(secret)
+	if errs := validation.IsDNS1123Subdomain(secret); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", credentialsSecretAnnotation, secret, strings.Join(errs, ", "))
+	}
+	credentialsType, err := ParseCredentialsType(annotations[credentialsTypeAnnotation])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", credentialsTypeAnnotation, err)
+	}
+	return &Credentials{Secret: secret, Type: credentialsType}, nil
+}
+
+// env returns the OP CLI credentials environment variables, read from the credentials Secret.
+func (c *Credentials) env() []corev1.EnvVar {
+	fromSecret := func(name, key string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: c.Secret},
+				Key:                  key,
+			}},
+		}
+	}
+	if c.Type == CredentialsConnect {
+		return []corev1.EnvVar{fromSecret(connectHostEnv, credentialsHostKey), fromSecret(connectTokenEnv, credentialsTokenKey)}
+	}
+	return []corev1.EnvVar{fromSecret(serviceAccountTokenEnv, credentialsTokenKey)}
+}
+
+// declaresCredentials reports whether the container declares any OP CLI credentials variable,
+// in which case the credentials Secret isn't used, not to mix the credentials of Connect and of a Service Account.
+func declaresCredentials(container *corev1.Container) bool {
+	for _, name := range []string{connectHostEnv, connectTokenEnv, serviceAccountTokenEnv} {
+		if findContainerEnvVarByName(name, container) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// apply adds the credentials to the container, unless it declares its own, and returns the corresponding patch.
+func (c *Credentials) apply(container *corev1.Container, containerIndex int, basePath string) []patchOperation {
+	if c == nil {
+		return nil
+	}
+	if declaresCredentials(container) {
+		glog.Infof("Not adding the credentials of Secret %s to container %s: it declares its own", c.Secret, container.Name)
+		return nil
+	}
+	return addEnvironment(container, containerIndex, basePath, c.env())
+}
+
+// addTo adds the credentials to a container created by the injector, unless it already has credentials.
+func (c *Credentials) addTo(container *corev1.Container) {
+	if c == nil || declaresCredentials(container) {
+		return
+	}
+	container.Env = append(c.env(), container.Env...)
+}
+
+// CredentialsPolicy is what the injector does with pods whose injected containers have no OP CLI credentials.
+type CredentialsPolicy string
+
+const (
+	// CredentialsPolicyIgnore admits the pod, the missing credentials are only logged.
+	CredentialsPolicyIgnore CredentialsPolicy = "ignore"
+	// CredentialsPolicyWarn admits the pod with a warning explaining which credentials are missing.
+	CredentialsPolicyWarn CredentialsPolicy = "warn"
+	// CredentialsPolicyDeny rejects the pod.
+	CredentialsPolicyDeny CredentialsPolicy = "deny"
+)
+
+// ParseCredentialsPolicy validates a credentials policy, warn being the default.
+func ParseCredentialsPolicy(value string) (CredentialsPolicy, error) {
+	switch policy := CredentialsPolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case "":
+		return CredentialsPolicyWarn, nil
+	case CredentialsPolicyIgnore, CredentialsPolicyWarn, CredentialsPolicyDeny:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid credentials policy %q, expected %q, %q or %q", value, CredentialsPolicyIgnore, CredentialsPolicyWarn, CredentialsPolicyDeny)
+	}
+}
+
+// hasOPCLICredentials reports whether the container may provide OP CLI credentials.
+// Variables loaded with envFrom can't be known at admission, so they are assumed to provide them.
+func hasOPCLICredentials(container *corev1.Container) bool {
+	if len(container.EnvFrom) > 0 {
+		return true
+	}
+	isConnectSetup := findContainerEnvVarByName(connectHostEnv, container) != nil && findContainerEnvVarByName(connectTokenEnv, container) != nil
+	return isConnectSetup || findContainerEnvVarByName(serviceAccountTokenEnv, container) != nil
+}
+
+// missingCredentials explains which injected containers lack the OP CLI credentials, or returns an empty string.
+// In run mode every injected container runs the OP CLI, in files mode only the secret files init container does,
+// with the credentials of the first injected container providing them.
+// Credentials read from a credentials Secret are always provided.
+func missingCredentials(config *injectionConfig, injected []corev1.Container) string {
+	if config.credentials != nil {
+		return ""
+	}
+
+	const expected = "set " + connectHostEnv + " and " + connectTokenEnv + ", or " + serviceAccountTokenEnv
+
+	if config.mode == injectionModeFiles {
+		for i := range injected {
+			if hasOPCLICredentials(&injected[i]) {
+				return ""
+			}
+		}
+		return fmt.Sprintf("no injected container provides 1Password CLI credentials to render the secret files: %s", expected)
+	}
+
+	var names []string
+	for i := range injected {
+		if !hasOPCLICredentials(&injected[i]) {
+			names = append(names, injected[i].Name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("no 1Password CLI credentials in container(s) %s: %s", strings.Join(names, ", "), expected)
+}
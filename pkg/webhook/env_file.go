@@ -0,0 +1,79 @@
+package webhook
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// injectEnvFileConfigMapAnnotation names the ConfigMap holding a dotenv file with secret references,
+	// passed to `op run` with --env-file.
+	injectEnvFileConfigMapAnnotation = "operator.1password.io/inject-env-file-configmap"
+	// injectEnvFileKeyAnnotation is the key of the dotenv file in the ConfigMap.
+	injectEnvFileKeyAnnotation = "operator.1password.io/inject-env-file-key"
+
+	defaultEnvFileKey = ".env"
+
+	// envFileVolumeName is the name of the volume holding the dotenv file.
+	envFileVolumeName = "op-env-file"
+	// envFileMountPath is the path where the dotenv file is mounted in the injected containers.
+	envFileMountPath = "/op/env/"
+)
+
+// envFile is a dotenv file, stored in a ConfigMap, with the secret references to load with `op run`.
+type envFile struct {
+	configMap string
+	key       string
+}
+
+// newEnvFile returns the env file requested by the pod annotations, or nil if none is requested.
+func newEnvFile(annotations map[string]string) (*envFile, error) {
+	configMap := strings.TrimSpace(annotations[injectEnvFileConfigMapAnnotation])
+	if configMap == "" {
+		return nil, nil
+	}
+
+	key := strings.TrimSpace(annotations[injectEnvFileKeyAnnotation])
+	if key == "" {
+		key = defaultEnvFileKey
+	}
+	if strings.Contains(key, "/") || key == "." || key == ".." {
+		return nil, fmt.Errorf("invalid %s %q", injectEnvFileKeyAnnotation, key)
+	}
+
+	return &envFile{
+		configMap: configMap,
+		key:       key,
+	}, nil
+}
+
+// volume returns the volume projecting the dotenv file only.
+func (ef *envFile) volume() corev1.Volume {
+	return corev1.Volume{
+		Name: envFileVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: ef.configMap},
+				Items: []corev1.KeyToPath{
+					{Key: ef.key, Path: ef.key},
+				},
+			},
+		},
+	}
+}
+
+func (ef *envFile) volumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      envFileVolumeName,
+		MountPath: envFileMountPath,
+		ReadOnly:  true,
+	}
+}
+
+// runOption returns the `op run` option loading the dotenv file.
+func (ef *envFile) runOption() string {
+	return "--env-file=" + path.Join(envFileMountPath, ef.key)
+}
@@ -0,0 +1,193 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// injectEphemeralAnnotation opts a pod in for secret injection into the ephemeral containers added to it (e.g. with kubectl debug).
+	injectEphemeralAnnotation = "operator.1password.io/inject-ephemeral"
+
+	ephemeralContainersSubResource = "ephemeralcontainers"
+	ephemeralContainersBasePath    = "/spec/ephemeralContainers"
+	// ephemeralImageMountPath is where an OP CLI image volume is mounted in the ephemeral containers,
+	// which can't mount a subPath of it at the usual path.
+	ephemeralImageMountPath = "/op/image/"
+)
+
+// mutateEphemeralContainers injects secrets into the ephemeral containers being added to an already injected pod.
+// Only the ephemeral containers can be changed through the ephemeralcontainers subresource, therefore the OP CLI
+// is taken from the existing OP CLI volumes and the pod is left untouched when it was not injected at creation.
+func (s *SecretInjector) mutateEphemeralContainers(ctx context.Context, req *admissionv1.AdmissionRequest, pod *corev1.Pod) *admissionv1.AdmissionResponse {
+	enabled, _ := strconv.ParseBool(pod.Annotations[injectEphemeralAnnotation])
+	if !enabled {
+		glog.Infof("Secret injection into ephemeral containers not enabled for %s/%s", pod.Namespace, pod.Name)
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	// ephemeral containers can't be changed once added, only mutate the ones added by this request
+	existing := map[string]struct{}{}
+	if len(req.OldObject.Raw) > 0 {
+		var oldPod corev1.Pod
+		if err := json.Unmarshal(req.OldObject.Raw, &oldPod); err != nil {
+			glog.Errorf("Could not unmarshal raw old object: %v", err)
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		}
+		for _, ec := range oldPod.Spec.EphemeralContainers {
+			existing[ec.Name] = struct{}{}
+		}
+	}
+
+	// the env file can only be used if the pod was created with its volume
+	envFile, err := newEnvFile(pod.Annotations)
+	if err != nil || !hasVolume(pod, envFileVolumeName) {
+		envFile = nil
+	}
+
+	var patch []patchOperation
+	for i := range pod.Spec.EphemeralContainers {
+		ec := pod.Spec.EphemeralContainers[i]
+		if _, ok := existing[ec.Name]; ok {
+			continue
+		}
+
+		c := corev1.Container(ec.EphemeralContainerCommon)
+		binMount := targetBinVolumeMount(pod, ec.TargetContainerName)
+		binVolume := findVolume(pod, binMount.Name)
+		if binVolume == nil {
+			glog.Infof("Not injecting secrets into ephemeral container %s of %s/%s: the pod has no %s volume", c.Name, pod.Namespace, pod.Name, binMount.Name)
+			continue
+		}
+		opPath := binVolumeMountPath + "op"
+		if binVolume.Image != nil {
+			// the API server rejects the subPath mounts of ephemeral containers, the whole image is mounted instead
+			binMount = corev1.VolumeMount{Name: binMount.Name, MountPath: ephemeralImageMountPath, ReadOnly: true}
+			opPath = ephemeralImageMountPath + s.CLIImage.binDir(binVolume.Image.Reference) + "/op"
+		}
+		envPatch := inheritTargetEnvironment(pod, &c, ec.TargetContainerName, i)
+
+		var runOptions []string
+		if envFile != nil {
+			envPatch = append(envPatch, addVolumeMounts(&c, i, ephemeralContainersBasePath, envFile.volumeMount())...)
+			runOptions = append(runOptions, envFile.runOption())
+		}
+
+		didMutate, containerPatch, err := s.mutateContainer(ctx, pod, &c, i, ephemeralContainersBasePath, binMount, opPath, runOptions)
+		if err != nil {
+			glog.Error("Error occurred mutating ephemeral container for secret injection: ", err)
+			s.recordEvent(ctx, req, pod, corev1.EventTypeWarning, reasonFailed, err.Error())
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		}
+		if !didMutate {
+			continue
+		}
+		glog.Infof("Injecting secrets into ephemeral container %s of %s/%s requested by %s", c.Name, pod.Namespace, pod.Name, req.UserInfo.Username)
+		s.recordEvent(ctx, req, pod, corev1.EventTypeNormal, reasonInjected, fmt.Sprintf("injected secrets into ephemeral container %s requested by %s", c.Name, req.UserInfo.Username))
+		patch = append(patch, envPatch...)
+		patch = append(patch, containerPatch...)
+	}
+
+	if len(patch) == 0 {
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+	return patchResponse(patchBytes)
+}
+
+// inheritTargetEnvironment adds the environment of the target container, which holds the secret references and
+// OP CLI credentials, to the ephemeral container. Variables already set on the ephemeral container are kept.
+func inheritTargetEnvironment(pod *corev1.Pod, container *corev1.Container, targetName string, containerIndex int) []patchOperation {
+	if targetName == "" {
+		return nil
+	}
+
+	var target *corev1.Container
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == targetName {
+			target = &pod.Spec.Containers[i]
+			break
+		}
+	}
+	if target == nil {
+		return nil
+	}
+
+	env := append([]corev1.EnvVar{}, container.Env...)
+	for _, envVar := range target.Env {
+		// the integration variables are set again when the ephemeral container is mutated
+		if strings.HasPrefix(envVar.Name, "OP_INTEGRATION_") {
+			continue
+		}
+		if findContainerEnvVarByName(envVar.Name, container) == nil {
+			env = append(env, envVar)
+		}
+	}
+	if len(env) == len(container.Env) {
+		return nil
+	}
+	container.Env = env
+
+	return []patchOperation{{
+		Op:    "add",
+		Path:  fmt.Sprintf("%s/%d/env", ephemeralContainersBasePath, containerIndex),
+		Value: env,
+	}}
+}
+
+// targetBinVolumeMount returns the OP CLI volume mount of the target container, so that the ephemeral container
+// runs the same OP CLI version. The pod level OP CLI volume is used when the target container isn't injected.
+func targetBinVolumeMount(pod *corev1.Pod, targetName string) corev1.VolumeMount {
+	for _, container := range pod.Spec.Containers {
+		if container.Name != targetName {
+			continue
+		}
+		for _, mount := range container.VolumeMounts {
+			if mount.MountPath == binVolumeMountPath && strings.HasPrefix(mount.Name, binVolumeName) {
+				return mount
+			}
+		}
+	}
+	return binVolumeMount
+}
+
+func hasVolume(pod *corev1.Pod, name string) bool {
+	return findVolume(pod, name) != nil
+}
+
+func findVolume(pod *corev1.Pod, name string) *corev1.Volume {
+	for i := range pod.Spec.Volumes {
+		if pod.Spec.Volumes[i].Name == name {
+			return &pod.Spec.Volumes[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// eventSourceComponent is the component reported as the source of the injection events.
+	eventSourceComponent = "1password-secrets-injector"
+
+	reasonInjected = "SecretsInjected"
+	reasonSkipped  = "SecretsInjectionSkipped"
+	reasonFailed   = "SecretsInjectionFailed"
+
+	eventTimeout = 5 * time.Second
+)
+
+// NewEventRecorder returns the recorder of the injection events. The events are sent to the API server in the
+// background, aggregated and rate limited by the recorder, until stop is closed.
+func NewEventRecorder(stop <-chan struct{}) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8sClient.CoreV1().Events("")})
+	go func() {
+		<-stop
+		broadcaster.Shutdown()
+	}()
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventSourceComponent})
+}
+
+// recordEvent records an event about the injection into the pod, so that users can diagnose the injection
+// with kubectl describe instead of reading the injector logs.
+// Pods being created don't exist yet, so the event is recorded on their owning workload, or on their namespace.
+// Events are never recorded for dry-run requests nor pod templates.
+// When the admission is audited, the injection is reported as audited as it's not applied.
+func (s *SecretInjector) recordEvent(ctx context.Context, req *admissionv1.AdmissionRequest, pod *corev1.Pod, eventType, reason, message string) {
+	if s.EventRecorder == nil || (req.DryRun != nil && *req.DryRun) || isTemplate(ctx) {
+		return
+	}
+	if isAudit(ctx) {
+		if reason == reasonInjected {
+			reason = reasonAudited
+		}
+		message = "audit mode: " + message
+	}
+
+	involved, direct := eventInvolvedObject(pod)
+	if direct {
+		s.EventRecorder.Event(&involved, eventType, reason, message)
+		return
+	}
+
+	name := pod.Name
+	if name == "" {
+		name = pod.GenerateName
+	}
+	message = fmt.Sprintf("Pod %s: %s", name, message)
+	// the workload is looked up in the background, not to delay the admission
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+		defer cancel()
+		workload := resolveWorkload(ctx, involved)
+		s.EventRecorder.Event(&workload, eventType, reason, message)
+	}()
+}
+
+// eventInvolvedObject returns the object the event is recorded on and whether it's the pod itself,
+// which is only the case when the pod already exists, e.g. when ephemeral containers are added.
+func eventInvolvedObject(pod *corev1.Pod) (corev1.ObjectReference, bool) {
+	if pod.UID != "" {
+		return corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  pod.Namespace,
+			Name:       pod.Name,
+			UID:        pod.UID,
+		}, true
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		return corev1.ObjectReference{
+			APIVersion: owner.APIVersion,
+			Kind:       owner.Kind,
+			Namespace:  pod.Namespace,
+			Name:       owner.Name,
+			UID:        owner.UID,
+		}, false
+	}
+	// events of a namespaced object must be in its namespace, so the namespace is set even though
+	// namespaces are cluster scoped: the events are listed by `kubectl get events` in the pod's namespace
+	return corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Namespace:  pod.Namespace,
+		Name:       pod.Namespace,
+	}, false
+}
+
+// resolveWorkload returns the workload managing the pod's owner, e.g. the Deployment of a ReplicaSet
+// or the CronJob of a Job, as that's the object users know about. The owner is kept when it has no controller.
+func resolveWorkload(ctx context.Context, owner corev1.ObjectReference) corev1.ObjectReference {
+	var meta *metav1.ObjectMeta
+	switch owner.Kind {
+	case "ReplicaSet":
+		replicaSet, err := k8sClient.AppsV1().ReplicaSets(owner.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			glog.Warningf("Could not get the owner of %s %s/%s: %v", owner.Kind, owner.Namespace, owner.Name, err)
+			return owner
+		}
+		meta = &replicaSet.ObjectMeta
+	case "Job":
+		job, err := k8sClient.BatchV1().Jobs(owner.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			glog.Warningf("Could not get the owner of %s %s/%s: %v", owner.Kind, owner.Namespace, owner.Name, err)
+			return owner
+		}
+		meta = &job.ObjectMeta
+	default:
+		return owner
+	}
+
+	controller := metav1.GetControllerOf(meta)
+	if controller == nil {
+		return owner
+	}
+	return corev1.ObjectReference{
+		APIVersion: controller.APIVersion,
+		Kind:       controller.Kind,
+		Namespace:  owner.Namespace,
+		Name:       controller.Name,
+		UID:        controller.UID,
+	}
+}
@@ -0,0 +1,46 @@
+package webhook
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImageVolumesSupported reports whether the API server accepts pods with image volumes, by creating a pod
+// mounting the OP CLI image in dry-run mode. The API server drops image volume sources when the ImageVolume
+// feature is disabled, so the pod is rejected or returned without its image volume in that case.
+func ImageVolumesSupported(ctx context.Context, namespace string, cliImage CLIImage) bool {
+	image := cliImage.reference(defaultOpCLIVersion)
+	probe := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "op-image-volume-probe-",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:            "probe",
+				Image:           image,
+				SecurityContext: restrictedSecurityContext(),
+				VolumeMounts: []corev1.VolumeMount{{
+					Name:      binVolumeName,
+					MountPath: binVolumeMountPath,
+					SubPath:   cliImage.binDir(image),
+					ReadOnly:  true,
+				}},
+			}},
+			Volumes: []corev1.Volume{cliImage.binImageVolume(binVolumeName, defaultOpCLIVersion)},
+		},
+	}
+
+	created, err := k8sClient.CoreV1().Pods(namespace).Create(ctx, probe, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	if err != nil {
+		glog.Warningf("Image volumes are not supported: %v", err)
+		return false
+	}
+	if len(created.Spec.Volumes) == 0 || created.Spec.Volumes[0].Image == nil {
+		glog.Warning("Image volumes are not supported: the ImageVolume feature is disabled")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// opCLIUser is the non-root user of the OP CLI image, set explicitly as the image user is not numeric.
+const opCLIUser int64 = 999
+
+// restrictedSecurityContext returns the security context of the injected init containers,
+// compliant with the "restricted" Pod Security Standard.
+func restrictedSecurityContext() *corev1.SecurityContext {
+	runAsNonRoot := true
+	allowPrivilegeEscalation := false
+	readOnlyRootFilesystem := true
+	user := opCLIUser
+	return &corev1.SecurityContext{
+		RunAsNonRoot:             &runAsNonRoot,
+		RunAsUser:                &user,
+		RunAsGroup:               &user,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+// secureInitContainers sets the security context and the resources of the injected init containers.
+func (s *SecretInjector) secureInitContainers(containers []corev1.Container) {
+	for i := range containers {
+		containers[i].SecurityContext = restrictedSecurityContext()
+		containers[i].Resources = *s.InitContainerResources.DeepCopy()
+	}
+}
+
+// ParseResources builds the resource requirements of the injected init containers.
+// Empty quantities are left unset.
+func ParseResources(cpuRequest, memoryRequest, cpuLimit, memoryLimit string) (corev1.ResourceRequirements, error) {
+	var resources corev1.ResourceRequirements
+	for _, q := range []struct {
+		list     *corev1.ResourceList
+		name     corev1.ResourceName
+		quantity string
+	}{
+		{&resources.Requests, corev1.ResourceCPU, cpuRequest},
+		{&resources.Requests, corev1.ResourceMemory, memoryRequest},
+		{&resources.Limits, corev1.ResourceCPU, cpuLimit},
+		{&resources.Limits, corev1.ResourceMemory, memoryLimit},
+	} {
+		if q.quantity == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(q.quantity)
+		if err != nil {
+			return resources, fmt.Errorf("invalid %s quantity %q: %w", q.name, q.quantity, err)
+		}
+		if *q.list == nil {
+			*q.list = corev1.ResourceList{}
+		}
+		(*q.list)[q.name] = quantity
+	}
+	return resources, nil
+}
@@ -17,6 +17,8 @@ import (
 var (
 	webhookConfigName = "secrets-injector-webhook-config"
 	webhookInjectPath = "/inject"
+	// webhookTimeoutSeconds is how long the API server waits for the admission of a request.
+	webhookTimeoutSeconds int32 = 10
 )
 
 var k8sClient kubernetes.Interface
@@ -48,11 +50,14 @@ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 See the License for the specific language governing permissions and
 limitations under the License.
 */
-func CreateOrUpdateMutatingWebhookConfiguration(caPEM *bytes.Buffer, webhookService, webhookNamespace string) error {
+func CreateOrUpdateMutatingWebhookConfiguration(caPEM *bytes.Buffer, webhookService, webhookNamespace string, workloads []WorkloadTemplate, objectSelector *metav1.LabelSelector) error {
 	glog.Infof("Creating or updating the mutatingwebhookconfiguration: %s", webhookConfigName)
 	mutatingWebhookConfigV1Client := k8sClient.AdmissionregistrationV1()
 	fail := admissionregistrationv1.Fail
-	sideEffect := admissionregistrationv1.SideEffectClassNone
+	// events are recorded about the injection, except for dry-run requests
+	sideEffect := admissionregistrationv1.SideEffectClassNoneOnDryRun
+	// the injection is idempotent, so the webhook can safely run again when a later webhook changed the pod
+	reinvocationPolicy := admissionregistrationv1.IfNeededReinvocationPolicy
 	mutatingWebhookConfig := &admissionregistrationv1.MutatingWebhookConfiguration{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: webhookConfigName,
@@ -78,18 +83,31 @@ func CreateOrUpdateMutatingWebhookConfiguration(caPEM *bytes.Buffer, webhookServ
 					Rule: admissionregistrationv1.Rule{
 						APIGroups:   []string{""},
 						APIVersions: []string{"v1"},
-						Resources:   []string{"pods"},
+						Resources:   []string{"pods", "pods/" + ephemeralContainersSubResource},
 					},
 				},
 			},
 			NamespaceSelector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"secrets-injection": "enabled",
-				},
+				MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key:      injectionNamespaceLabel,
+					Operator: metav1.LabelSelectorOpIn,
+					Values:   []string{injectionEnabled, injectionAudit},
+				}},
 			},
-			FailurePolicy: &fail,
+			// the objects not matching the selector are never sent to the webhook, and so are admitted even when it's down
+			ObjectSelector:     objectSelector,
+			FailurePolicy:      &fail,
+			ReinvocationPolicy: &reinvocationPolicy,
+			TimeoutSeconds:     &webhookTimeoutSeconds,
 		}},
 	}
+	if len(workloads) > 0 {
+		// the workloads are admitted by a webhook of their own, so that they can be told apart from the pods
+		workloadsWebhook := *mutatingWebhookConfig.Webhooks[0].DeepCopy()
+		workloadsWebhook.Name = "workloads.secrets-injector.1password.com"
+		workloadsWebhook.Rules = workloadRules(workloads)
+		mutatingWebhookConfig.Webhooks = append(mutatingWebhookConfig.Webhooks, workloadsWebhook)
+	}
 
 	foundWebhookConfig, err := mutatingWebhookConfigV1Client.MutatingWebhookConfigurations().Get(context.TODO(), webhookConfigName, metav1.GetOptions{})
 	if err != nil && apierrors.IsNotFound(err) {
@@ -117,3 +135,29 @@ func CreateOrUpdateMutatingWebhookConfiguration(caPEM *bytes.Buffer, webhookServ
 
 	return nil
 }
+
+// workloadRules returns the webhook rules matching the workload resources, one per API group and version.
+func workloadRules(workloads []WorkloadTemplate) []admissionregistrationv1.RuleWithOperations {
+	var rules []admissionregistrationv1.RuleWithOperations
+	indexes := map[string]int{}
+	for _, workload := range workloads {
+		key := workload.Group + "/" + workload.Version
+		i, ok := indexes[key]
+		if !ok {
+			i = len(rules)
+			indexes[key] = i
+			rules = append(rules, admissionregistrationv1.RuleWithOperations{
+				Operations: []admissionregistrationv1.OperationType{
+					admissionregistrationv1.Create,
+					admissionregistrationv1.Update,
+				},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{workload.Group},
+					APIVersions: []string{workload.Version},
+				},
+			})
+		}
+		rules[i].Resources = append(rules[i].Resources, workload.Resource)
+	}
+	return rules
+}
@@ -0,0 +1,102 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+)
+
+// namespaceResync is how often the cached namespaces are resynced.
+const namespaceResync = 10 * time.Minute
+
+// namespaceDefaultAnnotations are the injection annotations that can be set on a namespace,
+// as defaults of the pods created in it.
+var namespaceDefaultAnnotations = []string{
+	injectAnnotation,
+	injectExcludeAnnotation,
+	injectModeAnnotation,
+	versionAnnotation,
+	accountAnnotation,
+	noMaskingAnnotation,
+	credentialsSecretAnnotation,
+	credentialsTypeAnnotation,
+}
+
+// NewNamespaceLister caches the namespaces with an informer, so that their labels and annotations are read
+// without querying the API server on every admission. It returns once the cache is synced.
+func NewNamespaceLister(stop <-chan struct{}) (corev1listers.NamespaceLister, error) {
+	factory := informers.NewSharedInformerFactory(k8sClient, namespaceResync)
+	lister := factory.Core().V1().Namespaces().Lister()
+	factory.Start(stop)
+	for informer, synced := range factory.WaitForCacheSync(stop) {
+		if !synced {
+			return nil, fmt.Errorf("could not sync the cache of %v", informer)
+		}
+	}
+	glog.Info("Namespaces cache synced")
+	return lister, nil
+}
+
+// namespace returns the namespace, from the cache when there is one, or nil if it doesn't exist.
+// A namespace missing from the cache is read from the API server, as the cache lags behind
+// for the namespaces that were just created, e.g. with their pods by the same kubectl apply.
+func (s *SecretInjector) namespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	var namespace *corev1.Namespace
+	var err error
+	if s.Namespaces != nil {
+		namespace, err = s.Namespaces.Get(name)
+	}
+	if s.Namespaces == nil || apierrors.IsNotFound(err) {
+		namespace, err = k8sClient.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get namespace %s: %w", name, err)
+	}
+	return namespace, nil
+}
+
+// namespaceDefaults returns the injection annotations set on the namespace.
+func namespaceDefaults(namespace *corev1.Namespace) map[string]string {
+	if namespace == nil {
+		return nil
+	}
+	defaults := map[string]string{}
+	for _, annotation := range namespaceDefaultAnnotations {
+		if value, ok := namespace.Annotations[annotation]; ok {
+			defaults[annotation] = value
+		}
+	}
+	return defaults
+}
+
+// withDefaults returns the pod annotations completed with the namespace defaults, the pod annotations taking precedence.
+// The pod annotations are left untouched, as they are patched with the injection status.
+func withDefaults(annotations, defaults map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return annotations
+	}
+	merged := make(map[string]string, len(annotations)+len(defaults))
+	for key, value := range defaults {
+		merged[key] = value
+	}
+	for key, value := range annotations {
+		merged[key] = value
+	}
+	// the credentials type describes the credentials Secret it's set with
+	if _, ok := annotations[credentialsSecretAnnotation]; ok {
+		if _, ok := annotations[credentialsTypeAnnotation]; !ok {
+			delete(merged, credentialsTypeAnnotation)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,209 @@
+package webhook
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// injectFilesConfigMapAnnotation names the ConfigMap holding the templates of the secret files.
+	// Every key of the ConfigMap is rendered with `op inject` into a file of the same name.
+	injectFilesConfigMapAnnotation = "operator.1password.io/inject-files-configmap"
+	// injectFilesPathAnnotation is the path where the rendered secret files are mounted in the injected containers.
+	injectFilesPathAnnotation = "operator.1password.io/inject-files-path"
+
+	defaultSecretFilesMountPath = "/op/secrets"
+
+	// secretFilesInitContainerName is the name of the init container rendering the secret files.
+	secretFilesInitContainerName = "op-inject-files"
+
+	// secretFilesVolumeName is the name of the in-memory volume where the rendered secret files are stored.
+	secretFilesVolumeName = "op-secrets"
+	// secretTemplatesVolumeName is the name of the volume holding the templates of the secret files.
+	secretTemplatesVolumeName = "op-secrets-templates"
+
+	secretFilesRenderPath     = "/op/secrets/"
+	secretTemplatesRenderPath = "/op/templates/"
+
+	// opConfigVolumeName is the name of the volume holding the OP CLI configuration of the init container,
+	// as its root filesystem is read-only.
+	opConfigVolumeName = "op-config"
+	opConfigMountPath  = "/op/config/"
+	// opConfigDir is created by the OP CLI itself, with the permissions it expects.
+	opConfigDir = opConfigMountPath + "op"
+)
+
+// secretFiles describes the secret files rendered for a pod.
+type secretFiles struct {
+	configMap string
+	mountPath string
+	dotenvs   []dotenvFile
+}
+
+// dotenvFile is a dotenv file holding the secrets referenced in the environment of a container.
+type dotenvFile struct {
+	name     string
+	template string
+}
+
+// newSecretFiles returns the secret files requested by the pod annotations, or nil if none are requested.
+// In files mode, secret files are always rendered as it's the only way secrets are delivered.
+func newSecretFiles(annotations map[string]string, filesOnly bool) (*secretFiles, error) {
+	configMap := strings.TrimSpace(annotations[injectFilesConfigMapAnnotation])
+	if configMap == "" && !filesOnly {
+		return nil, nil
+	}
+
+	mountPath := strings.TrimSpace(annotations[injectFilesPathAnnotation])
+	if mountPath == "" {
+		mountPath = defaultSecretFilesMountPath
+	}
+	if !path.IsAbs(mountPath) {
+		return nil, fmt.Errorf("%s must be an absolute path, got %q", injectFilesPathAnnotation, mountPath)
+	}
+
+	return &secretFiles{
+		configMap: configMap,
+		mountPath: path.Clean(mountPath),
+	}, nil
+}
+
+// addDotenv renders the secret references in the container environment into the `<container name>.env` file.
+func (sf *secretFiles) addDotenv(container *corev1.Container) {
+	var lines []string
+	for _, envVar := range container.Env {
+		reference := strings.TrimSpace(envVar.Value)
+		if strings.HasPrefix(reference, secretReferencePrefix) {
+			lines = append(lines, fmt.Sprintf("%s={{ %s }}", envVar.Name, reference))
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+	sf.dotenvs = append(sf.dotenvs, dotenvFile{
+		name:     container.Name + ".env",
+		template: strings.Join(lines, "\n") + "\n",
+	})
+}
+
+// volumes returns the template, rendered files and OP CLI configuration volumes.
+// The rendered files live in memory only, so secrets are never written to the node's disk.
+func (sf *secretFiles) volumes() []corev1.Volume {
+	var volumes []corev1.Volume
+	if sf.configMap != "" {
+		volumes = append(volumes, corev1.Volume{
+			Name: secretTemplatesVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: sf.configMap},
+				},
+			},
+		})
+	}
+	return append(volumes,
+		corev1.Volume{
+			Name: secretFilesVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{
+					Medium: corev1.StorageMediumMemory,
+				},
+			},
+		},
+		corev1.Volume{
+			Name: opConfigVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{
+					Medium: corev1.StorageMediumMemory,
+				},
+			},
+		},
+	)
+}
+
+// volumeMount returns the read-only mount of the rendered files for the injected containers.
+func (sf *secretFiles) volumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      secretFilesVolumeName,
+		MountPath: sf.mountPath,
+		ReadOnly:  true,
+	}
+}
+
+// initContainer returns the init container rendering every template and dotenv file with `op inject`,
+// running the OP CLI binary of binMount. The OP CLI credentials are taken from the first injected container providing them.
+// The files are made readable by all users, as the app may not run with the same user as the OP CLI image;
+// only the containers the volume is mounted into can access them.
+// With a bundled OP CLI, the files are rendered by the injector image, which has no shell, so that the OP CLI image
+// isn't pulled; otherwise they are rendered by a shell script in the OP CLI image of the given version.
+func (sf *secretFiles) initContainer(ci *CLIImage, version string, binMount corev1.VolumeMount, injected []corev1.Container) corev1.Container {
+	const inject = binVolumeMountPath + "op inject --force --file-mode=0644"
+
+	script := []string{"set -e"}
+	args := []string{"/injector", InjectFilesCommand, "-op=" + binVolumeMountPath + "op", "-destination=" + secretFilesRenderPath}
+	env := append(credentialsEnvVars(injected), userAgentEnvVars()...)
+	env = append(env, corev1.EnvVar{Name: "OP_CONFIG_DIR", Value: opConfigDir})
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      secretFilesVolumeName,
+			MountPath: secretFilesRenderPath,
+		},
+		{
+			Name:      opConfigVolumeName,
+			MountPath: opConfigMountPath,
+		},
+		binMount,
+	}
+
+	if sf.configMap != "" {
+		script = append(script, fmt.Sprintf(`for template in %[1]s*; do %[2]s --in-file "$template" --out-file "%[3]s$(basename "$template")"; done`,
+			secretTemplatesRenderPath, inject, secretFilesRenderPath))
+		args = append(args, "-templates="+secretTemplatesRenderPath)
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      secretTemplatesVolumeName,
+			MountPath: secretTemplatesRenderPath,
+			ReadOnly:  true,
+		})
+	}
+
+	// dotenv templates are passed through the environment, as they are not stored in any object of the cluster
+	for i, dotenv := range sf.dotenvs {
+		templateEnv := fmt.Sprintf("OP_DOTENV_TEMPLATE_%d", i)
+		script = append(script, fmt.Sprintf(`printf '%%s' "$%s" | %s --out-file "%s%s"`,
+			templateEnv, inject, secretFilesRenderPath, dotenv.name))
+		args = append(args, fmt.Sprintf("-dotenv=%s=%s", dotenv.name, templateEnv))
+		env = append(env, corev1.EnvVar{Name: templateEnv, Value: dotenv.template})
+	}
+
+	container := corev1.Container{
+		Name:            secretFilesInitContainerName,
+		Image:           ci.image(version),
+		ImagePullPolicy: ci.pullPolicy(),
+		Command:         []string{"sh", "-c", strings.Join(script, "\n")},
+		Env:             env,
+		VolumeMounts:    volumeMounts,
+	}
+	if ci.Bundled != nil {
+		container.Image = ci.Bundled.Image
+		container.Command = args
+	}
+	return container
+}
+
+// credentialsEnvVars returns the OP CLI credentials environment variables of the first container that provides them.
+func credentialsEnvVars(containers []corev1.Container) []corev1.EnvVar {
+	for i := range containers {
+		var env []corev1.EnvVar
+		for _, name := range []string{connectHostEnv, connectTokenEnv, serviceAccountTokenEnv} {
+			if envVar := findContainerEnvVarByName(name, &containers[i]); envVar != nil {
+				env = append(env, *envVar)
+			}
+		}
+		if len(env) > 0 {
+			return env
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// secretMappingAnnotationPrefix is the prefix of the annotations mapping a secret reference to an environment variable
+// of a container: `secrets.operator.1password.io/<container>.<ENV_NAME>: op://vault/item/field`.
+const secretMappingAnnotationPrefix = "secrets.operator.1password.io/"
+
+// secretMappings are the environment variables declared in the pod annotations, by container name.
+type secretMappings map[string][]corev1.EnvVar
+
+// newSecretMappings reads the secret mappings from the pod annotations.
+func newSecretMappings(annotations map[string]string) (secretMappings, error) {
+	mappings := secretMappings{}
+	for key, value := range annotations {
+		name, ok := strings.CutPrefix(key, secretMappingAnnotationPrefix)
+		if !ok {
+			continue
+		}
+
+		// container names can't contain dots, so the first one separates the container from the variable name
+		container, envName, ok := strings.Cut(name, ".")
+		if !ok || container == "" || envName == "" {
+			return nil, fmt.Errorf("invalid secret mapping annotation %s, expected %s<container>.<ENV_NAME>", key, secretMappingAnnotationPrefix)
+		}
+		reference := strings.TrimSpace(value)
+		if !strings.HasPrefix(reference, secretReferencePrefix) {
+			return nil, fmt.Errorf("invalid secret mapping annotation %s: %q is not a secret reference", key, value)
+		}
+
+		mappings[container] = append(mappings[container], corev1.EnvVar{Name: envName, Value: reference})
+	}
+
+	// annotations are unordered, sort the variables to produce a stable patch
+	for _, env := range mappings {
+		sort.Slice(env, func(i, j int) bool { return env[i].Name < env[j].Name })
+	}
+	return mappings, nil
+}
+
+// apply adds the variables mapped to the container to its environment and returns the corresponding patch.
+// Variables already defined in the container spec take precedence over the annotations.
+func (sm secretMappings) apply(container *corev1.Container, containerIndex int, basePath string) []patchOperation {
+	var added []corev1.EnvVar
+	for _, envVar := range sm[container.Name] {
+		if findContainerEnvVarByName(envVar.Name, container) != nil {
+			glog.Infof("Ignoring secret mapping of %s for container %s: the variable is already defined", envVar.Name, container.Name)
+			continue
+		}
+		added = append(added, envVar)
+	}
+	return addEnvironment(container, containerIndex, basePath, added)
+}
@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// reviewUpdate admits the update of a pod. The pod spec is mostly immutable once the pod is created,
+// so secrets are only injected at creation and updates are never patched.
+// When ProtectInjection is set, the updates tampering with the injection of an injected pod are denied.
+func (s *SecretInjector) reviewUpdate(ctx context.Context, req *admissionv1.AdmissionRequest, pod *corev1.Pod) *admissionv1.AdmissionResponse {
+	if !s.ProtectInjection || len(req.OldObject.Raw) == 0 {
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	var oldPod corev1.Pod
+	if err := json.Unmarshal(req.OldObject.Raw, &oldPod); err != nil {
+		glog.Errorf("Could not unmarshal raw old object: %v", err)
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	if tampering := injectionTampering(&oldPod, pod); tampering != "" {
+		glog.Warningf("Denying the update of %s/%s by %s: %s", pod.Namespace, pod.Name, req.UserInfo.Username, tampering)
+		s.recordEvent(ctx, req, pod, corev1.EventTypeWarning, reasonFailed, fmt.Sprintf("denied the update by %s: %s", req.UserInfo.Username, tampering))
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: tampering,
+			},
+		}
+	}
+	return &admissionv1.AdmissionResponse{
+		Allowed: true,
+	}
+}
+
+// injectionTampering explains how the update of an injected pod tampers with its injection, or returns an empty string.
+// Only the annotations and the images of the containers can be changed on a running pod: the injection status
+// must be kept, and the images of the injected init containers, which provide the OP CLI, must not change.
+func injectionTampering(oldPod, pod *corev1.Pod) string {
+	if strings.ToLower(oldPod.Annotations[injectionStatus]) != "injected" {
+		return ""
+	}
+	if status := pod.Annotations[injectionStatus]; strings.ToLower(status) != "injected" {
+		return fmt.Sprintf("the %s annotation of an injected pod can't be changed", injectionStatus)
+	}
+
+	images := map[string]string{}
+	for _, c := range pod.Spec.InitContainers {
+		images[c.Name] = c.Image
+	}
+	for _, c := range oldPod.Spec.InitContainers {
+		if !isInjectedInitContainer(c.Name) {
+			continue
+		}
+		if image, ok := images[c.Name]; ok && image != c.Image {
+			return fmt.Sprintf("the image of the injected init container %s can't be changed", c.Name)
+		}
+	}
+	return ""
+}
+
+// isInjectedInitContainer reports whether the init container was added by the injector.
+func isInjectedInitContainer(name string) bool {
+	return name == binInitContainerName || strings.HasPrefix(name, binInitContainerName+"-") || name == secretFilesInitContainerName
+}
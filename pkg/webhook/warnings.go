@@ -0,0 +1,109 @@
+package webhook
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// pinnedVersionPattern is the format of an OP CLI version that is not a floating tag, e.g. 2.30.0.
+var pinnedVersionPattern = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+// configurationWarnings returns admission warnings about misconfigurations of the injection,
+// so that they are shown to the user, e.g. by kubectl apply, instead of only being logged by the injector.
+func (s *SecretInjector) configurationWarnings(pod *corev1.Pod, containers containerSelector, config *injectionConfig) []string {
+	podContainers := map[string]*corev1.Container{}
+	var all []*corev1.Container
+	for i := range pod.Spec.InitContainers {
+		all = append(all, &pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		all = append(all, &pod.Spec.Containers[i])
+	}
+	for _, c := range all {
+		podContainers[c.Name] = c
+	}
+
+	var warnings []string
+
+	// containers referenced by the annotations
+	referenced := map[string]struct{}{}
+	for name := range containers.names {
+		referenced[name] = struct{}{}
+	}
+	for name := range containers.excluded {
+		referenced[name] = struct{}{}
+	}
+	for name := range config.secretMappings {
+		referenced[name] = struct{}{}
+	}
+	for key := range config.annotations {
+		for _, annotation := range []string{versionAnnotation, accountAnnotation, noMaskingAnnotation} {
+			if name, ok := strings.CutPrefix(key, annotation+"."); ok {
+				referenced[name] = struct{}{}
+			}
+		}
+	}
+	for _, name := range sortedKeys(referenced) {
+		if _, ok := podContainers[name]; !ok {
+			warnings = append(warnings, fmt.Sprintf("container %s is referenced by the secret injection annotations but is not in the pod", name))
+		}
+	}
+
+	// secret references are also loaded from the env file and the secret files templates
+	referencesFromFiles := config.envFile != nil || (config.secretFiles != nil && config.secretFiles.configMap != "")
+	for _, c := range all {
+		if !containers.selects(c) {
+			continue
+		}
+		if _, listed := containers.names[c.Name]; listed && !referencesFromFiles && !hasSecretReferences(c) && len(config.secretMappings[c.Name]) == 0 {
+			warnings = append(warnings, fmt.Sprintf("container %s is set for secret injection but has no %s secret reference in its environment", c.Name, secretReferencePrefix))
+		}
+		hasConnect := findContainerEnvVarByName(connectHostEnv, c) != nil || findContainerEnvVarByName(connectTokenEnv, c) != nil
+		if hasConnect && findContainerEnvVarByName(serviceAccountTokenEnv, c) != nil {
+			warnings = append(warnings, fmt.Sprintf("container %s sets both 1Password Connect and Service Account credentials, only one of them is used", c.Name))
+		}
+	}
+
+	// floating tags make the OP CLI version change without the pod spec changing.
+	// Only the versions set by the annotations are checked: the default version is chosen by the injector's operator.
+	if config.mode == injectionModeRun || config.secretFiles != nil {
+		versions := map[string]string{}
+		for key, value := range config.annotations {
+			if key == versionAnnotation || strings.HasPrefix(key, versionAnnotation+".") {
+				versions[key] = strings.TrimSpace(value)
+			}
+		}
+		for _, key := range sortedKeys(versions) {
+			if s.isFloatingVersion(versions[key]) {
+				warnings = append(warnings, fmt.Sprintf("%s %q is a floating tag of the 1Password CLI image, pin a version such as 2.30.0", key, versions[key]))
+			}
+		}
+	}
+
+	return warnings
+}
+
+// isFloatingVersion reports whether the OP CLI binary of the version may change over time.
+// Versions pinned to a digest or provided by the binary bundled in the injector image never change.
+func (s *SecretInjector) isFloatingVersion(version string) bool {
+	if pinnedVersionPattern.MatchString(version) {
+		return false
+	}
+	if _, pinned := s.CLIImage.Digests[version]; pinned {
+		return false
+	}
+	return s.CLIImage.Bundled == nil || !s.CLIImage.Bundled.provides(version)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/1password/kubernetes-secrets-injector/pkg/registry"
 	"github.com/1password/kubernetes-secrets-injector/pkg/utils"
 	"github.com/1password/kubernetes-secrets-injector/version"
 	"github.com/golang/glog"
@@ -16,6 +19,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
@@ -31,6 +36,21 @@ const (
 	binVolumeMountPath = "/op/bin/"
 
 	defaultOpCLIVersion = "2"
+
+	// binInitContainerName is the name of the init container that copies the OP CLI binary into binVolume.
+	binInitContainerName = "copy-op-bin"
+
+	// CopyOPCommand is the injector subcommand copying the bundled OP CLI binary into binVolume.
+	CopyOPCommand = "copy-op"
+	// InjectFilesCommand is the injector subcommand rendering the secret files with the OP CLI binary of binVolume.
+	InjectFilesCommand = "inject-files"
+
+	containersBasePath     = "/spec/containers"
+	initContainersBasePath = "/spec/initContainers"
+
+	// admissionTimeout bounds the admission of a request, including the registry calls resolving the image commands.
+	// It's shorter than webhookTimeoutSeconds, after which the API server fails the request.
+	admissionTimeout = 8 * time.Second
 )
 
 // binVolume is the shared, in-memory volume where the OP CLI binary lives.
@@ -57,20 +77,151 @@ var (
 )
 
 const (
-	injectionStatus   = "operator.1password.io/status"
-	injectAnnotation  = "operator.1password.io/inject"
-	versionAnnotation = "operator.1password.io/version"
+	injectionStatus      = "operator.1password.io/status"
+	injectAnnotation     = "operator.1password.io/inject"
+	versionAnnotation    = "operator.1password.io/version"
+	injectModeAnnotation = "operator.1password.io/inject-mode"
+
+	// injectOptOut is the value of injectAnnotation opting a pod out of the injection.
+	injectOptOut = "false"
+)
+
+// injectionMode is how secrets are delivered to the injected containers.
+type injectionMode string
+
+const (
+	// injectionModeRun wraps the container command with `op run`, which passes secrets as environment variables.
+	injectionModeRun injectionMode = "run"
+	// injectionModeFiles leaves the container command untouched and only delivers secrets as files.
+	injectionModeFiles injectionMode = "files"
 )
 
+// injectionConfig is the pod level configuration of the injection, read from the pod annotations.
+type injectionConfig struct {
+	annotations    map[string]string
+	mode           injectionMode
+	version        string
+	secretFiles    *secretFiles
+	envFile        *envFile
+	secretMappings secretMappings
+	credentials    *Credentials
+	// cliVersions are the OP CLI versions run by the injected containers, in order of first use.
+	cliVersions []string
+}
+
+func newInjectionConfig(annotations map[string]string) (*injectionConfig, error) {
+	mode, err := parseInjectionMode(annotations[injectModeAnnotation])
+	if err != nil {
+		return nil, err
+	}
+
+	secretFiles, err := newSecretFiles(annotations, mode == injectionModeFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	envFile, err := newEnvFile(annotations)
+	if err != nil {
+		return nil, err
+	}
+	if envFile != nil && mode != injectionModeRun {
+		return nil, fmt.Errorf("%s requires the %q injection mode", injectEnvFileConfigMapAnnotation, injectionModeRun)
+	}
+
+	secretMappings, err := newSecretMappings(annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := newCredentials(annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	version := defaultOpCLIVersion
+	if value, ok := annotations[versionAnnotation]; ok {
+		if version, err = parseCLIVersion(value); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkCLIVersions(annotations, version); err != nil {
+		return nil, err
+	}
+
+	return &injectionConfig{
+		annotations:    annotations,
+		mode:           mode,
+		version:        version,
+		secretFiles:    secretFiles,
+		envFile:        envFile,
+		secretMappings: secretMappings,
+		credentials:    credentials,
+	}, nil
+}
+
+func parseInjectionMode(value string) (injectionMode, error) {
+	switch mode := injectionMode(strings.ToLower(strings.TrimSpace(value))); mode {
+	case "":
+		return injectionModeRun, nil
+	case injectionModeRun, injectionModeFiles:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid %s %q, expected %q or %q", injectModeAnnotation, value, injectionModeRun, injectionModeFiles)
+	}
+}
+
 type SecretInjector struct {
 	Server *http.Server
+	// Registry resolves the image ENTRYPOINT and CMD of containers that do not define a command.
+	// When nil, only containers with a command can be injected.
+	Registry *registry.Client
+	// CLIImage is the OP CLI image of the injected init containers.
+	CLIImage CLIImage
+	// InitContainerResources are the resource requirements of the injected init containers.
+	InitContainerResources corev1.ResourceRequirements
+	// CredentialsPolicy is what happens to pods whose injected containers have no OP CLI credentials,
+	// warn when empty.
+	CredentialsPolicy CredentialsPolicy
+	// Audit audits the injection in all namespaces instead of enforcing it: the pods are admitted unchanged and
+	// the injection that would have been done is logged and returned as warnings.
+	// The injection is also audited in the namespaces labeled with secrets-injection=audit.
+	Audit bool
+	// Credentials is the default credentials Secret of the injected containers, unused when empty.
+	// It's overridden by the credentials Secret annotations of the namespaces and of the pods.
+	Credentials Credentials
+	// ProtectInjection denies the updates of injected pods changing their injection status annotation
+	// or the images of their injected init containers.
+	ProtectInjection bool
+	// Workloads is how the pod templates of the workloads are admitted, only pods are admitted when empty.
+	Workloads WorkloadMode
+	// WorkloadTemplates are the workload resources admitted in addition to the pods, with the path of their pod template.
+	WorkloadTemplates []WorkloadTemplate
+	// Namespaces caches the namespaces, whose labels and annotations are read on every admission.
+	// The namespaces are read from the API server when nil.
+	Namespaces corev1listers.NamespaceLister
+	// EventRecorder records Kubernetes events about the injection on the injected pods' workloads,
+	// see NewEventRecorder. No event is recorded when nil.
+	EventRecorder record.EventRecorder
+	// ImageVolumes mounts the OP CLI from an image volume instead of copying it with an init container.
+	// Only enable it when the cluster supports image volumes, see ImageVolumesSupported.
+	ImageVolumes bool
 }
 
 // the command line parameters for configuraing the webhook
 type SecretInjectorParameters struct {
-	Port     int    // webhook server port
-	CertFile string // path to the x509 certificate for https
-	KeyFile  string // path to the x509 private key matching `CertFile`
+	Port     int      // webhook server port
+	CertFile string   // path to the x509 certificate for https
+	KeyFile  string   // path to the x509 private key matching `CertFile`
+	CLIImage CLIImage // the OP CLI image of the injected init containers
+	// the resource requirements of the injected init containers
+	InitContainerResources corev1.ResourceRequirements
+	// what happens to pods whose injected containers have no OP CLI credentials
+	CredentialsPolicy CredentialsPolicy
+	// the default credentials Secret of the injected containers
+	Credentials Credentials
+	// how the pod templates of the workloads are admitted, and the admitted workload resources
+	Workloads         WorkloadMode
+	WorkloadTemplates []WorkloadTemplate
 }
 
 type patchOperation struct {
@@ -87,7 +238,11 @@ func mutationRequired(metadata *metav1.ObjectMeta) bool {
 	}
 
 	status := annotations[injectionStatus]
-	_, enabled := annotations[injectAnnotation]
+	inject, enabled := annotations[injectAnnotation]
+	// the pod opts out of the injection, e.g. when it's enabled by default for its namespace
+	if strings.EqualFold(strings.TrimSpace(inject), injectOptOut) {
+		enabled = false
+	}
 
 	// if pod has not already been injected and injection has been enabled mark the pod for injection
 	required := false
@@ -99,31 +254,53 @@ func mutationRequired(metadata *metav1.ObjectMeta) bool {
 	return required
 }
 
-func addContainers(target, added []corev1.Container, basePath string) (patch []patchOperation) {
-	first := len(target) == 0
-	var value interface{}
+// prependContainers inserts the added containers at the beginning of the target list,
+// so that they run before any of the existing (init) containers.
+// Containers already in the target list, e.g. added by a previous invocation of the webhook, are skipped.
+func prependContainers(target, added []corev1.Container, basePath string) (patch []patchOperation) {
+	existing := map[string]struct{}{}
+	for _, c := range target {
+		existing[c.Name] = struct{}{}
+	}
+	var missing []corev1.Container
 	for _, add := range added {
-		value = add
-		path := basePath
-		if first {
-			first = false
-			value = []corev1.Container{add}
-		} else {
-			path = path + "/-"
+		if _, ok := existing[add.Name]; !ok {
+			missing = append(missing, add)
 		}
+	}
+
+	if len(missing) == 0 {
+		return patch
+	}
+	if len(target) == 0 {
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath,
+			Value: missing,
+		})
+	}
+	for i, add := range missing {
 		patch = append(patch, patchOperation{
 			Op:    "add",
-			Path:  path,
-			Value: value,
+			Path:  fmt.Sprintf("%s/%d", basePath, i),
+			Value: add,
 		})
 	}
 	return patch
 }
 
+// addVolume adds the volumes missing from the target list.
 func addVolume(target, added []corev1.Volume, basePath string) (patch []patchOperation) {
+	existing := map[string]struct{}{}
+	for _, v := range target {
+		existing[v.Name] = struct{}{}
+	}
 	first := len(target) == 0
 	var value interface{}
 	for _, add := range added {
+		if _, ok := existing[add.Name]; ok {
+			continue
+		}
 		value = add
 		path := basePath
 		if first {
@@ -181,11 +358,14 @@ func updateAnnotation(target map[string]string, added map[string]string) (patch
 }
 
 // mutation process for injecting secrets into pods
-func (s *SecretInjector) mutate(ar *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
-	ctx := context.Background()
+func (s *SecretInjector) mutate(ctx context.Context, ar *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 	req := ar.Request
 	var pod corev1.Pod
-	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+	workload, isWorkload := s.workloadTemplate(req.Resource)
+	if isWorkload {
+		// the pod template is read from the workload, only its name is used until then
+		pod.Name = req.Name
+	} else if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
 		glog.Errorf("Could not unmarshal raw object: %v", err)
 		return &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
@@ -197,44 +377,102 @@ func (s *SecretInjector) mutate(ar *admissionv1.AdmissionReview) *admissionv1.Ad
 	glog.Infof("Checking if secret injection is needed for %v %s at namespace %v",
 		req.Kind, pod.Name, req.Namespace)
 
+	// the namespace is not set on the pod object yet when it's created through a controller
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+
+	namespace, err := s.namespace(ctx, pod.Namespace)
+	if err != nil {
+		glog.Error("Could not get the namespace of the pod: ", err)
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	audit := s.auditMode(namespace)
+	if audit {
+		ctx = withAudit(ctx)
+	}
+
+	defaults := withDefaults(namespaceDefaults(namespace), s.Credentials.annotations())
+	var response *admissionv1.AdmissionResponse
+	switch {
+	case isWorkload:
+		response = s.mutateWorkload(ctx, req, workload, defaults)
+	case req.SubResource == ephemeralContainersSubResource:
+		response = s.mutateEphemeralContainers(ctx, req, &pod)
+	case req.Operation == admissionv1.Update:
+		response = s.reviewUpdate(ctx, req, &pod)
+	default:
+		response = s.mutatePod(ctx, req, &pod, defaults)
+	}
+	if audit {
+		return auditResponse(&pod, response)
+	}
+	return response
+}
+
+// mutatePod injects secrets into the containers of the pod being created.
+// The injection annotations missing from the pod are taken from the defaults of its namespace.
+func (s *SecretInjector) mutatePod(ctx context.Context, req *admissionv1.AdmissionRequest, pod *corev1.Pod, defaults map[string]string) *admissionv1.AdmissionResponse {
+	annotations := withDefaults(pod.Annotations, defaults)
+
 	// determine whether to inject secrets
-	if !mutationRequired(&pod.ObjectMeta) {
+	if !mutationRequired(&metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace, Annotations: annotations}) {
 		glog.Infof("Secret injection not required for %s at namespace %s", pod.Name, pod.Namespace)
 		return &admissionv1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 
-	containersStr := pod.Annotations[injectAnnotation]
-
-	containers := map[string]struct{}{}
-
-	if containersStr == "" {
+	containers := newContainerSelector(annotations[injectAnnotation], annotations[injectExcludeAnnotation])
+	if containers.isEmpty() {
 		glog.Infof("No containers set for secret injection for %s/%s", pod.Namespace, pod.Name)
+		s.recordEvent(ctx, req, pod, corev1.EventTypeNormal, reasonSkipped, fmt.Sprintf("no containers set for secret injection by %s", injectAnnotation))
 		return &admissionv1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
-	for _, container := range strings.Split(containersStr, ",") {
-		containers[container] = struct{}{}
+
+	config, err := newInjectionConfig(annotations)
+	if err != nil {
+		glog.Error("Invalid secret injection configuration: ", err)
+		s.recordEvent(ctx, req, pod, corev1.EventTypeWarning, reasonFailed, err.Error())
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
 	}
 
-	versionAnnotation, ok := pod.Annotations[versionAnnotation]
-	if !ok {
-		versionAnnotation = defaultOpCLIVersion
+	warnings := s.configurationWarnings(pod, containers, config)
+	for _, warning := range warnings {
+		glog.Warningf("Pod %s/%s: %s", pod.Namespace, pod.Name, warning)
 	}
 
 	mutated := false
+	var injected []corev1.Container
 
 	var patch []patchOperation
 	for i := range pod.Spec.InitContainers {
 		c := pod.Spec.InitContainers[i]
-		_, mutate := containers[c.Name]
-		if !mutate {
+		envPatch := config.secretMappings.apply(&c, i, initContainersBasePath)
+		if !containers.selects(&c) {
 			continue
 		}
-		didMutate, initContainerPatch, err := s.mutateContainer(ctx, &c, i)
+		if isNativeSidecar(&c) {
+			glog.Infof("Container %s of %s/%s is a native sidecar", c.Name, pod.Namespace, pod.Name)
+		}
+		if config.mode == injectionModeRun {
+			envPatch = append(envPatch, config.credentials.apply(&c, i, initContainersBasePath)...)
+		}
+		didMutate, initContainerPatch, err := s.injectContainer(ctx, pod, &c, i, initContainersBasePath, config)
 		if err != nil {
+			glog.Error("Error occurred mutating init container for secret injection: ", err)
+			s.recordEvent(ctx, req, pod, corev1.EventTypeWarning, reasonFailed, err.Error())
 			return &admissionv1.AdmissionResponse{
 				Result: &metav1.Status{
 					Message: err.Error(),
@@ -243,64 +481,139 @@ func (s *SecretInjector) mutate(ar *admissionv1.AdmissionReview) *admissionv1.Ad
 		}
 		if didMutate {
 			mutated = true
+			injected = append(injected, c)
 		}
+		patch = append(patch, envPatch...)
 		patch = append(patch, initContainerPatch...)
 	}
 
 	for i := range pod.Spec.Containers {
 		c := pod.Spec.Containers[i]
-		_, mutate := containers[c.Name]
-		if !mutate {
+		envPatch := config.secretMappings.apply(&c, i, containersBasePath)
+		if !containers.selects(&c) {
 			continue
 		}
+		if config.mode == injectionModeRun {
+			envPatch = append(envPatch, config.credentials.apply(&c, i, containersBasePath)...)
+		}
 
-		didMutate, containerPatch, err := s.mutateContainer(ctx, &c, i)
+		didMutate, containerPatch, err := s.injectContainer(ctx, pod, &c, i, containersBasePath, config)
 		if err != nil {
 			glog.Error("Error occurred mutating container for secret injection: ", err)
+			s.recordEvent(ctx, req, pod, corev1.EventTypeWarning, reasonFailed, err.Error())
 			return &admissionv1.AdmissionResponse{
 				Result: &metav1.Status{
 					Message: err.Error(),
 				},
 			}
 		}
+		patch = append(patch, envPatch...)
 		patch = append(patch, containerPatch...)
 		if didMutate {
 			mutated = true
+			injected = append(injected, c)
 		}
 	}
 
 	if !mutated {
 		glog.Infof("No containers set for secret injection for %s/%s", pod.Namespace, pod.Name)
+		s.recordEvent(ctx, req, pod, corev1.EventTypeNormal, reasonSkipped, fmt.Sprintf("no container of the pod matches %s %q", injectAnnotation, annotations[injectAnnotation]))
 		return &admissionv1.AdmissionResponse{
-			Allowed: true,
+			Allowed:  true,
+			Warnings: warnings,
 		}
 	}
 
-	// binInitContainer is the container that pulls the OP CLI
-	// into a shared volume mount.
-	var binInitContainer = corev1.Container{
-		Name:            "copy-op-bin",
-		Image:           "1password/op" + ":" + versionAnnotation,
-		ImagePullPolicy: corev1.PullIfNotPresent,
-		Command: []string{"sh", "-c",
-			fmt.Sprintf("cp /usr/local/bin/op %s", binVolumeMountPath)},
-		VolumeMounts: []corev1.VolumeMount{
-			{
-				Name:      binVolumeName,
-				MountPath: binVolumeMountPath,
-			},
-		},
+	if missing := missingCredentials(config, injected); missing != "" {
+		glog.Warningf("Pod %s/%s: %s", pod.Namespace, pod.Name, missing)
+		switch s.CredentialsPolicy {
+		case CredentialsPolicyDeny:
+			s.recordEvent(ctx, req, pod, corev1.EventTypeWarning, reasonFailed, missing)
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: missing,
+				},
+			}
+		case CredentialsPolicyWarn, "":
+			warnings = append(warnings, missing)
+		}
 	}
 
-	patchBytes, err := createOPCLIPatch(&pod, []corev1.Container{binInitContainer}, patch)
+	var renderer *corev1.Container
+	if config.secretFiles != nil {
+		// the secret files are rendered with the same OP CLI binary as the one the containers run,
+		// copied, and verified when checksums are configured, by the copy-op-bin init container
+		container := config.secretFiles.initContainer(&s.CLIImage, config.version, s.binVolumeMount(config, config.version), injected)
+		// in files mode, the credentials are only given to the init container rendering the secret files
+		config.credentials.addTo(&container)
+		renderer = &container
+	}
+
+	var volumes []corev1.Volume
+	var initContainers []corev1.Container
+	// in files mode only the init container rendering the secret files runs the OP CLI
+	for _, version := range config.cliVersions {
+		if s.usesImageVolume(version) {
+			volumes = append(volumes, s.CLIImage.binImageVolume(config.binVolumeName(version), version))
+			continue
+		}
+		binVolume := binVolume
+		binVolume.Name = config.binVolumeName(version)
+		volumes = append(volumes, binVolume)
+		initContainers = append(initContainers, s.CLIImage.binInitContainer(config.binInitContainerName(version), binVolume.Name, version))
+	}
+	if config.envFile != nil {
+		volumes = append(volumes, config.envFile.volume())
+	}
+	if renderer != nil {
+		volumes = append(volumes, config.secretFiles.volumes()...)
+		initContainers = append(initContainers, *renderer)
+	}
+
+	s.secureInitContainers(initContainers)
+	// the OP CLI image is pulled by the injected init containers or the image volumes
+	patch = append(patch, s.CLIImage.addImagePullSecrets(pod)...)
+
+	patchBytes, err := createOPCLIPatch(pod, volumes, initContainers, patch)
 	if err != nil {
+		s.recordEvent(ctx, req, pod, corev1.EventTypeWarning, reasonFailed, err.Error())
 		return &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
 		}
 	}
+	s.recordEvent(ctx, req, pod, corev1.EventTypeNormal, reasonInjected, s.injectedMessage(config, injected))
+	response := patchResponse(patchBytes)
+	response.Warnings = warnings
+	return response
+}
+
+// injectedMessage describes the injection into the pod: which containers were injected and with which OP CLI images.
+func (s *SecretInjector) injectedMessage(config *injectionConfig, injected []corev1.Container) string {
+	var names []string
+	for _, c := range injected {
+		names = append(names, c.Name)
+	}
+
+	var images []string
+	if config.mode == injectionModeRun {
+		for _, version := range config.cliVersions {
+			images = append(images, s.CLIImage.reference(version))
+		}
+	}
+	if config.secretFiles != nil {
+		if image := s.CLIImage.image(config.version); !slices.Contains(images, image) {
+			images = append(images, image)
+		}
+	}
 
+	return fmt.Sprintf("injected secrets in %s mode into container(s) %s with 1Password CLI image(s) %s",
+		config.mode, strings.Join(names, ", "), strings.Join(images, ", "))
+}
+
+// patchResponse admits the request with the given JSON patch.
+func patchResponse(patchBytes []byte) *admissionv1.AdmissionResponse {
 	glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
 	return &admissionv1.AdmissionResponse{
 		Allowed: true,
@@ -312,17 +625,28 @@ func (s *SecretInjector) mutate(ar *admissionv1.AdmissionReview) *admissionv1.Ad
 	}
 }
 
-// create mutation patch for resources
-func createOPCLIPatch(pod *corev1.Pod, containers []corev1.Container, patch []patchOperation) ([]byte, error) {
+// create mutation patch for resources.
+// The given init containers are prepended to the pod's init containers, so that the OP CLI binary
+// is available before any injected init container starts. Container patches in `patch` refer to
+// the original container indexes, therefore they must be applied before the init containers are inserted.
+// Artifacts of a previous injection, such as the ones of a workload's pod template injected again on update, are kept as they are.
+func createOPCLIPatch(pod *corev1.Pod, volumes []corev1.Volume, containers []corev1.Container, patch []patchOperation) ([]byte, error) {
+
+	patch = append(patch, addVolume(pod.Spec.Volumes, volumes, "/spec/volumes")...)
+	patch = append(patch, prependContainers(pod.Spec.InitContainers, containers, initContainersBasePath)...)
 
 	annotations := map[string]string{injectionStatus: "injected"}
-	patch = append(patch, addVolume(pod.Spec.Volumes, []corev1.Volume{binVolume}, "/spec/volumes")...)
-	patch = append(patch, addContainers(pod.Spec.InitContainers, containers, "/spec/initContainers")...)
 	patch = append(patch, updateAnnotation(pod.Annotations, annotations)...)
 
 	return json.Marshal(patch)
 }
 
+// isNativeSidecar reports whether the init container is a native sidecar,
+// i.e. an init container with restartPolicy: Always that keeps running alongside the app containers.
+func isNativeSidecar(container *corev1.Container) bool {
+	return container.RestartPolicy != nil && *container.RestartPolicy == corev1.ContainerRestartPolicyAlways
+}
+
 func isEnvVarSetup(envVarName string) func(c *corev1.Container) bool {
 	return func(container *corev1.Container) bool {
 		envVar := findContainerEnvVarByName(envVarName, container)
@@ -367,8 +691,173 @@ func checkOPCLIEnvSetup(container *corev1.Container) {
 	}
 }
 
-func passUserAgentInformationToCLI(container *corev1.Container, containerIndex int) []patchOperation {
-	userAgentEnvs := []corev1.EnvVar{
+// injectContainer injects secrets into the container according to the injection mode:
+// in run mode the container command is wrapped with `op run`, in files mode only the secret files are mounted.
+func (s *SecretInjector) injectContainer(ctx context.Context, pod *corev1.Pod, container *corev1.Container, containerIndex int, basePath string, config *injectionConfig) (bool, []patchOperation, error) {
+	var patch []patchOperation
+	if config.secretFiles != nil {
+		mount := config.secretFiles.volumeMount()
+		// unlike the OP CLI binary mount, an existing mount would hide the secret files
+		if existing := volumeMountAt(container, mount.MountPath); existing != nil && existing.Name != mount.Name {
+			return false, nil, fmt.Errorf("not attaching OP to the container %s: the volume %s is already mounted at %s, set %s to another path",
+				container.Name, existing.Name, existing.MountPath, injectFilesPathAnnotation)
+		}
+		patch = append(patch, addVolumeMounts(container, containerIndex, basePath, mount)...)
+	}
+
+	if config.mode == injectionModeFiles {
+		config.secretFiles.addDotenv(container)
+		return true, patch, nil
+	}
+
+	version, err := config.cliVersion(container.Name)
+	if err != nil {
+		return false, nil, err
+	}
+	runOptions, err := config.runOptions(container.Name)
+	if err != nil {
+		return false, nil, err
+	}
+	if config.envFile != nil {
+		patch = append(patch, addVolumeMounts(container, containerIndex, basePath, config.envFile.volumeMount())...)
+		runOptions = append(runOptions, config.envFile.runOption())
+	}
+	binMount := s.binVolumeMount(config, version)
+	didMutate, containerPatch, err := s.mutateContainer(ctx, pod, container, containerIndex, basePath, binMount, binVolumeMountPath+"op", runOptions)
+	return didMutate, append(patch, containerPatch...), err
+}
+
+// binVolumeMount returns the mount of the volume holding the binary of the given OP CLI version,
+// which is then provided to the pod.
+func (s *SecretInjector) binVolumeMount(config *injectionConfig, version string) corev1.VolumeMount {
+	binMount := config.useCLIVersion(version)
+	if s.usesImageVolume(version) {
+		// only the directory of the binary is mounted, so that it's found at the same path as when it's copied
+		binMount.SubPath = s.CLIImage.binDir(s.CLIImage.reference(version))
+	}
+	return binMount
+}
+
+// usesImageVolume reports whether the given OP CLI version is mounted from an image volume rather than copied.
+func (s *SecretInjector) usesImageVolume(version string) bool {
+	return s.ImageVolumes && !s.CLIImage.verifies(version)
+}
+
+// binInitContainer returns the init container that pulls the given OP CLI version
+// and copies its binary into the named volume.
+// It's a regular init container (no restartPolicy) placed before every other init container,
+// so that it has completed before any injected init container or native sidecar starts.
+func (ci *CLIImage) binInitContainer(name, volumeName, version string) corev1.Container {
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      volumeName,
+			MountPath: binVolumeMountPath,
+		},
+	}
+	if ci.Bundled != nil && ci.Bundled.provides(version) {
+		checksums := []string{ci.Bundled.SHA256}
+		if ci.verifies(version) {
+			checksums = ci.Checksums[version]
+		}
+		return corev1.Container{
+			Name:            name,
+			Image:           ci.Bundled.Image,
+			ImagePullPolicy: ci.pullPolicy(),
+			Command: []string{"/injector", CopyOPCommand,
+				"-source=" + ci.Bundled.Path,
+				"-destination=" + binVolumeMountPath + "op",
+				"-sha256=" + strings.Join(checksums, ",")},
+			VolumeMounts: volumeMounts,
+			// a failed verification is reported as the reason of the init container failure
+			TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+		}
+	}
+
+	return corev1.Container{
+		Name:                     name,
+		Image:                    ci.image(version),
+		ImagePullPolicy:          ci.pullPolicy(),
+		Command:                  []string{"sh", "-c", ci.copyScript(version)},
+		VolumeMounts:             volumeMounts,
+		TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+	}
+}
+
+// addVolumeMounts adds the mounts missing from the container and returns the corresponding patch.
+// The slice shared with the pod spec is left unchanged.
+func addVolumeMounts(container *corev1.Container, containerIndex int, basePath string, mounts ...corev1.VolumeMount) (patch []patchOperation) {
+	path := fmt.Sprintf("%s/%d/volumeMounts", basePath, containerIndex)
+	for _, mount := range mounts {
+		// a path can only be mounted once, e.g. when the OP CLI version of the container changed
+		if hasVolumeMount(container, mount.Name) || hasMountPath(container, mount.MountPath) {
+			continue
+		}
+		if len(container.VolumeMounts) == 0 {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  path,
+				Value: []corev1.VolumeMount{mount},
+			})
+		} else {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  path + "/-",
+				Value: mount,
+			})
+		}
+		container.VolumeMounts = append(append([]corev1.VolumeMount{}, container.VolumeMounts...), mount)
+	}
+	return patch
+}
+
+func hasVolumeMount(container *corev1.Container, name string) bool {
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasMountPath(container *corev1.Container, mountPath string) bool {
+	return volumeMountAt(container, mountPath) != nil
+}
+
+// volumeMountAt returns the mount of the container at the given path, or nil if there is none.
+func volumeMountAt(container *corev1.Container, mountPath string) *corev1.VolumeMount {
+	for i, mount := range container.VolumeMounts {
+		if strings.TrimSuffix(mount.MountPath, "/") == strings.TrimSuffix(mountPath, "/") {
+			return &container.VolumeMounts[i]
+		}
+	}
+	return nil
+}
+
+// addEnvironment adds the variables missing from the container environment and returns the corresponding patch.
+func addEnvironment(container *corev1.Container, containerIndex int, basePath string, env []corev1.EnvVar) []patchOperation {
+	var missing []corev1.EnvVar
+	for _, envVar := range env {
+		if findContainerEnvVarByName(envVar.Name, container) == nil {
+			missing = append(missing, envVar)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	patch := setEnvironment(*container, containerIndex, missing, basePath)
+	container.Env = append(append([]corev1.EnvVar{}, container.Env...), missing...)
+	return patch
+}
+
+// isOPRunCommand reports whether the command is already wrapped with `op run` of the OP CLI at opPath.
+func isOPRunCommand(command []string, opPath string) bool {
+	return len(command) >= 2 && command[0] == opPath && command[1] == "run"
+}
+
+// userAgentEnvVars returns the environment variables passing User-Agent information to the CLI.
+func userAgentEnvVars() []corev1.EnvVar {
+	return []corev1.EnvVar{
 		{
 			Name:  "OP_INTEGRATION_NAME",
 			Value: "1Password Kubernetes Webhook",
@@ -382,34 +871,69 @@ func passUserAgentInformationToCLI(container *corev1.Container, containerIndex i
 			Value: utils.MakeBuildVersion(version.Version),
 		},
 	}
+}
 
-	return setEnvironment(*container, containerIndex, userAgentEnvs, "/spec/containers")
+func passUserAgentInformationToCLI(container *corev1.Container, containerIndex int, basePath string) []patchOperation {
+	return addEnvironment(container, containerIndex, basePath, userAgentEnvVars())
 }
 
-// mutates the container to allow for secrets to be injected into the container via the op cli
-func (s *SecretInjector) mutateContainer(cxt context.Context, container *corev1.Container, containerIndex int) (bool, []patchOperation, error) {
+// mutates the container to allow for secrets to be injected into the container via the op cli.
+// basePath is the JSON patch path of the list the container belongs to (e.g. /spec/containers or /spec/initContainers).
+// binMount is the mount of the volume holding the OP CLI binary the container runs, found at opPath.
+// runOptions are passed to `op run` before the container command.
+func (s *SecretInjector) mutateContainer(cxt context.Context, pod *corev1.Pod, container *corev1.Container, containerIndex int, basePath string, binMount corev1.VolumeMount, opPath string, runOptions []string) (bool, []patchOperation, error) {
+	var patch []patchOperation
+
+	// adding the cli to the container using a volume mount
+	patch = append(patch, addVolumeMounts(container, containerIndex, basePath, binMount)...)
+
+	// the command was already wrapped, e.g. by a previous invocation of the webhook
+	if isOPRunCommand(container.Command, opPath) {
+		glog.Infof("Command of container %s already runs with op run", container.Name)
+		checkOPCLIEnvSetup(container)
+		patch = append(patch, passUserAgentInformationToCLI(container, containerIndex, basePath)...)
+		return true, patch, nil
+	}
+
+	commandOp := "replace"
 	//  prepending op run command to the container command so that secrets are injected before the main process is started
 	if len(container.Command) == 0 {
-		return false, nil, fmt.Errorf("not attaching OP to the container %s: the podspec does not define a command", container.Name)
-	}
+		if s.Registry == nil {
+			return false, nil, fmt.Errorf("not attaching OP to the container %s: the podspec does not define a command", container.Name)
+		}
 
-	// Prepend the command with op run --
-	container.Command = append([]string{binVolumeMountPath + "op", "run", "--"}, container.Command...)
+		imageConfig, err := s.resolveImageConfig(cxt, pod, container)
+		if err != nil && cxt.Err() != nil {
+			return false, nil, fmt.Errorf("not attaching OP to the container %s: could not resolve image command in time: %w", container.Name, err)
+		}
+		if err != nil {
+			return false, nil, fmt.Errorf("not attaching OP to the container %s: the podspec does not define a command and the image command could not be resolved: %w", container.Name, err)
+		}
+		if len(imageConfig.Entrypoint) == 0 && len(imageConfig.Cmd) == 0 && len(container.Args) == 0 {
+			return false, nil, fmt.Errorf("not attaching OP to the container %s: neither the podspec nor the image %s define a command", container.Name, container.Image)
+		}
 
-	var patch []patchOperation
+		// Kubernetes ignores the image CMD once a command is set, so it has to be passed explicitly as args.
+		if len(container.Args) == 0 && len(imageConfig.Cmd) > 0 {
+			container.Args = imageConfig.Cmd
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("%s/%d/args", basePath, containerIndex),
+				Value: container.Args,
+			})
+		}
+		container.Command = imageConfig.Entrypoint
+		commandOp = "add"
+	}
 
-	// adding the cli to the container using a volume mount
-	path := fmt.Sprintf("%s/%d/volumeMounts", "/spec/containers", containerIndex)
-	patch = append(patch, patchOperation{
-		Op:    "add",
-		Path:  path,
-		Value: append(container.VolumeMounts, binVolumeMount),
-	})
+	// Prepend the command with op run [options] --
+	opRun := append([]string{opPath, "run"}, runOptions...)
+	container.Command = append(append(opRun, "--"), container.Command...)
 
 	// replacing the container command with a command prepended with op run
-	path = fmt.Sprintf("%s/%d/command", "/spec/containers", containerIndex)
+	path := fmt.Sprintf("%s/%d/command", basePath, containerIndex)
 	patch = append(patch, patchOperation{
-		Op:    "replace",
+		Op:    commandOp,
 		Path:  path,
 		Value: container.Command,
 	})
@@ -417,10 +941,30 @@ func (s *SecretInjector) mutateContainer(cxt context.Context, container *corev1.
 	checkOPCLIEnvSetup(container)
 
 	//creating patch for passing User-Agent information to the CLI.
-	patch = append(patch, passUserAgentInformationToCLI(container, containerIndex)...)
+	patch = append(patch, passUserAgentInformationToCLI(container, containerIndex, basePath)...)
 	return true, patch, nil
 }
 
+// resolveImageConfig fetches the ENTRYPOINT and CMD of the container image from its registry,
+// authenticating with the pod's image pull secrets.
+func (s *SecretInjector) resolveImageConfig(ctx context.Context, pod *corev1.Pod, container *corev1.Container) (*registry.ImageConfig, error) {
+	keychain := registry.Keychain{}
+	for _, pullSecret := range pod.Spec.ImagePullSecrets {
+		secret, err := k8sClient.CoreV1().Secrets(pod.Namespace).Get(ctx, pullSecret.Name, metav1.GetOptions{})
+		if err != nil {
+			// the kubelet ignores missing pull secrets too, the registry may not need them
+			glog.Warningf("Could not get image pull secret %s/%s: %v", pod.Namespace, pullSecret.Name, err)
+			continue
+		}
+		if err := keychain.AddPullSecret(secret); err != nil {
+			glog.Warningf("Ignoring image pull secret %s/%s: %v", pod.Namespace, pullSecret.Name, err)
+		}
+	}
+
+	glog.Infof("Resolving the command of image %s for container %s", container.Image, container.Name)
+	return s.Registry.ImageConfig(ctx, container.Image, keychain)
+}
+
 func setEnvironment(container corev1.Container, containerIndex int, addedEnv []corev1.EnvVar, basePath string) (patch []patchOperation) {
 	first := len(container.Env) == 0
 	var value interface{}
@@ -474,7 +1018,10 @@ func (s *SecretInjector) Serve(w http.ResponseWriter, r *http.Request) {
 			},
 		}
 	} else {
-		admissionResponse = s.mutate(&ar)
+		// the admission gives up before the API server does, so that the request fails with a meaningful error
+		ctx, cancel := context.WithTimeout(r.Context(), admissionTimeout)
+		admissionResponse = s.mutate(ctx, &ar)
+		cancel()
 	}
 
 	admissionReview := admissionv1.AdmissionReview{
@@ -2,21 +2,33 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"time"
 
+	"github.com/1password/kubernetes-secrets-injector/pkg/registry"
 	jsonpatch "github.com/evanphx/json-patch/v5"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	k8stestclient "k8s.io/client-go/kubernetes/fake"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	podsecurityapi "k8s.io/pod-security-admission/api"
+	"k8s.io/pod-security-admission/policy"
 )
 
 func createRequest(body io.Reader) *http.Request {
@@ -39,11 +51,15 @@ func parseResponseBody(rr *httptest.ResponseRecorder) *admissionv1.AdmissionResp
 func sendPodAndGetResponse(pod corev1.Pod, rr *httptest.ResponseRecorder, handler http.HandlerFunc) *admissionv1.AdmissionResponse {
 	raw, err := json.Marshal(pod)
 	Expect(err).NotTo(HaveOccurred())
+	return sendRequestAndGetResponse(&admissionv1.AdmissionRequest{
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: raw},
+	}, rr, handler)
+}
+
+func sendRequestAndGetResponse(request *admissionv1.AdmissionRequest, rr *httptest.ResponseRecorder, handler http.HandlerFunc) *admissionv1.AdmissionResponse {
 	ar := admissionv1.AdmissionReview{
-		Request: &admissionv1.AdmissionRequest{
-			Namespace: "default",
-			Object:    runtime.RawExtension{Raw: raw},
-		},
+		Request: request,
 	}
 	body, err := json.Marshal(ar)
 	Expect(err).NotTo(HaveOccurred())
@@ -52,6 +68,84 @@ func sendPodAndGetResponse(pod corev1.Pod, rr *httptest.ResponseRecorder, handle
 	return parseResponseBody(rr)
 }
 
+func applyPatchToPod(pod corev1.Pod, response *admissionv1.AdmissionResponse) corev1.Pod {
+	raw, err := json.Marshal(pod)
+	Expect(err).NotTo(HaveOccurred())
+
+	patch, err := jsonpatch.DecodePatch(response.Patch)
+	Expect(err).NotTo(HaveOccurred())
+	patchedRaw, err := patch.Apply(raw)
+	Expect(err).NotTo(HaveOccurred())
+
+	var patched corev1.Pod
+	Expect(json.Unmarshal(patchedRaw, &patched)).To(Succeed())
+	return patched
+}
+
+// testPod returns a pod with the given annotations and containers, as sent to the injector.
+func testPod(annotations map[string]string, containers ...corev1.Container) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			Containers: containers,
+		},
+	}
+}
+
+// testContainer returns a container running the command of the same name, with the given environment.
+func testContainer(name string, env ...corev1.EnvVar) corev1.Container {
+	return corev1.Container{Name: name, Command: []string{name}, Env: env}
+}
+
+// newImageRegistry starts a registry API V2 stand-in serving a single image with the given config,
+// that requires basic authentication with user:pass.
+func newImageRegistry(repository string, entrypoint, cmd []string) *httptest.Server {
+	config, err := json.Marshal(map[string]interface{}{
+		"config": map[string]interface{}{"Entrypoint": entrypoint, "Cmd": cmd},
+	})
+	Expect(err).NotTo(HaveOccurred())
+	manifest, err := json.Marshal(map[string]interface{}{
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config":    map[string]string{"digest": "sha256:config"},
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if username, password, ok := req.BasicAuth(); !ok || username != "user" || password != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/v2/" + repository + "/manifests/1.0", "/v2/" + repository + "/manifests/sha256:image":
+			w.Header().Set("Docker-Content-Digest", "sha256:image")
+			_, _ = w.Write(manifest)
+		case "/v2/" + repository + "/blobs/sha256:config":
+			_, _ = w.Write(config)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// restrictedProfileViolations evaluates the pod against the latest version of the "restricted" Pod Security Standard
+// (https://kubernetes.io/docs/concepts/security/pod-security-standards/#restricted) and returns the violations.
+func restrictedProfileViolations(pod corev1.Pod) []string {
+	evaluator, err := policy.NewEvaluator(policy.DefaultChecks())
+	Expect(err).NotTo(HaveOccurred())
+	results := evaluator.EvaluatePod(podsecurityapi.LevelVersion{Level: podsecurityapi.LevelRestricted, Version: podsecurityapi.LatestVersion()}, &pod.ObjectMeta, &pod.Spec)
+
+	var violations []string
+	for _, result := range results {
+		if !result.Allowed {
+			violations = append(violations, result.ForbiddenReason+": "+result.ForbiddenDetail)
+		}
+	}
+	return violations
+}
+
 var testNotPatch = map[string]struct {
 	pod corev1.Pod
 }{
@@ -123,6 +217,44 @@ var testNotPatch = map[string]struct {
 	},
 }
 
+var secretEnv = []corev1.EnvVar{{Name: "DB_PASSWORD", Value: "op://vault/db/password"}}
+
+var testContainerSelection = map[string]struct {
+	annotations map[string]string
+	expected    []string
+}{
+	"Inject list with whitespace": {
+		annotations: map[string]string{"operator.1password.io/inject": " app , init "},
+		expected:    []string{"init", "app"},
+	},
+	"Wildcard selects all containers": {
+		annotations: map[string]string{"operator.1password.io/inject": "*"},
+		expected:    []string{"init", "app", "worker", "proxy"},
+	},
+	"Wildcard with exclusions": {
+		annotations: map[string]string{
+			"operator.1password.io/inject":         "*",
+			"operator.1password.io/inject-exclude": "init, proxy",
+		},
+		expected: []string{"app", "worker"},
+	},
+	"Auto selects containers with secret references": {
+		annotations: map[string]string{"operator.1password.io/inject": "auto"},
+		expected:    []string{"app", "worker"},
+	},
+	"Auto combined with a container name": {
+		annotations: map[string]string{"operator.1password.io/inject": "auto,proxy"},
+		expected:    []string{"app", "worker", "proxy"},
+	},
+	"Auto with exclusions": {
+		annotations: map[string]string{
+			"operator.1password.io/inject":         "auto",
+			"operator.1password.io/inject-exclude": "worker",
+		},
+		expected: []string{"app"},
+	},
+}
+
 var _ = Describe("Webhook Test", Ordered, func() {
 	var rr *httptest.ResponseRecorder
 	var handler http.HandlerFunc
@@ -308,4 +440,2135 @@ var _ = Describe("Webhook Test", Ordered, func() {
 		})
 	})
 
+	Context("selects containers", func() {
+		for testCase, testData := range testContainerSelection {
+			When(testCase, func() {
+				It("injects the selected containers only", func() {
+					pod := testPod(testData.annotations, testContainer("app", secretEnv...), testContainer("worker", secretEnv...), testContainer("proxy"))
+					pod.Spec.InitContainers = []corev1.Container{{Name: "init", Command: []string{"setup"}}}
+					responseBody := sendPodAndGetResponse(pod, rr, handler)
+					Expect(responseBody.Patch).NotTo(BeNil())
+
+					patched := applyPatchToPod(pod, responseBody)
+					var injected []string
+					for _, c := range append(patched.Spec.InitContainers, patched.Spec.Containers...) {
+						if len(c.Command) > 0 && c.Command[0] == "/op/bin/op" {
+							injected = append(injected, c.Name)
+						}
+					}
+					Expect(injected).To(ConsistOf(testData.expected))
+				})
+			})
+		}
+
+		It("does not patch when all selected containers are excluded", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":         "app",
+				"operator.1password.io/inject-exclude": "app",
+			}, testContainer("app"))
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).To(BeNil())
+		})
+	})
+
+	Context("injects into init containers", func() {
+		It("patches init containers under /spec/initContainers", func() {
+			pod := testPod(map[string]string{"operator.1password.io/inject": "migrate"}, corev1.Container{Name: "app", Command: []string{"sleep", "infinity"}})
+			pod.Spec.InitContainers = []corev1.Container{
+				testContainer("setup"),
+				{Name: "migrate", Command: []string{"migrate", "up"}},
+			}
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			var patch []patchOperation
+			Expect(json.Unmarshal(responseBody.Patch, &patch)).To(Succeed())
+			for _, op := range patch {
+				Expect(op.Path).NotTo(HavePrefix("/spec/containers"))
+			}
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers).To(HaveLen(3))
+			Expect(patched.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+			Expect(patched.Spec.InitContainers[1].Command).To(Equal([]string{"setup"}))
+			Expect(patched.Spec.InitContainers[2].Command).To(Equal([]string{"/op/bin/op", "run", "--", "migrate", "up"}))
+			Expect(patched.Spec.InitContainers[2].VolumeMounts).To(ContainElement(binVolumeMount))
+			Expect(patched.Spec.Containers[0].Command).To(Equal([]string{"sleep", "infinity"}))
+		})
+
+		It("patches both init and regular containers", func() {
+			pod := testPod(map[string]string{"operator.1password.io/inject": "migrate,app"},
+				corev1.Container{Name: "sidecar", Command: []string{"proxy"}},
+				corev1.Container{Name: "app", Command: []string{"sleep", "infinity"}},
+			)
+			pod.Spec.InitContainers = []corev1.Container{{Name: "migrate", Command: []string{"migrate", "up"}}}
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers).To(HaveLen(2))
+			Expect(patched.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+			Expect(patched.Spec.InitContainers[1].Command).To(Equal([]string{"/op/bin/op", "run", "--", "migrate", "up"}))
+			Expect(patched.Spec.Containers[0].Command).To(Equal([]string{"proxy"}))
+			Expect(patched.Spec.Containers[0].Env).To(BeEmpty())
+			Expect(patched.Spec.Containers[1].Command).To(Equal([]string{"/op/bin/op", "run", "--", "sleep", "infinity"}))
+
+			for _, c := range []corev1.Container{patched.Spec.InitContainers[1], patched.Spec.Containers[1]} {
+				var envNames []string
+				for _, env := range c.Env {
+					envNames = append(envNames, env.Name)
+				}
+				Expect(envNames).To(ContainElements("OP_INTEGRATION_NAME", "OP_INTEGRATION_ID", "OP_INTEGRATION_BUILDNUMBER"))
+			}
+		})
+	})
+
+	Context("injects into native sidecars", func() {
+		It("wraps the sidecar command and copies the OP CLI before the sidecar starts", func() {
+			always := corev1.ContainerRestartPolicyAlways
+			pod := testPod(map[string]string{"operator.1password.io/inject": "log-shipper,app"}, corev1.Container{Name: "app", Command: []string{"sleep", "infinity"}})
+			pod.Spec.InitContainers = []corev1.Container{
+				testContainer("setup"),
+				{Name: "log-shipper", Command: []string{"ship-logs"}, RestartPolicy: &always},
+			}
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers).To(HaveLen(3))
+			Expect(patched.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+			Expect(isNativeSidecar(&patched.Spec.InitContainers[0])).To(BeFalse())
+
+			sidecar := patched.Spec.InitContainers[2]
+			Expect(sidecar.Name).To(Equal("log-shipper"))
+			Expect(isNativeSidecar(&sidecar)).To(BeTrue())
+			Expect(sidecar.Command).To(Equal([]string{"/op/bin/op", "run", "--", "ship-logs"}))
+			Expect(sidecar.VolumeMounts).To(ContainElement(binVolumeMount))
+			Expect(patched.Spec.Containers[0].Command).To(Equal([]string{"/op/bin/op", "run", "--", "sleep", "infinity"}))
+		})
+	})
+
+	Context("injects into ephemeral containers", func() {
+		injectedPod := func(annotations map[string]string) corev1.Pod {
+			pod := testPod(annotations, corev1.Container{
+				Name:    "app",
+				Command: []string{"/op/bin/op", "run", "--", "sleep", "infinity"},
+				Env: []corev1.EnvVar{
+					{Name: "OP_SERVICE_ACCOUNT_TOKEN", Value: "token"},
+					{Name: "DB_PASSWORD", Value: "op://vault/db/password"},
+					{Name: "OP_INTEGRATION_ID", Value: "K8W"},
+				},
+			})
+			pod.Name = "app"
+			pod.Spec.Volumes = []corev1.Volume{binVolume}
+			return pod
+		}
+
+		sendEphemeralContainerRequest := func(oldPod corev1.Pod) (corev1.Pod, *admissionv1.AdmissionResponse) {
+			pod := oldPod
+			pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+				EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+					Name:    "debugger",
+					Image:   "busybox",
+					Command: []string{"sh"},
+				},
+				TargetContainerName: "app",
+			})
+			raw, err := json.Marshal(pod)
+			Expect(err).NotTo(HaveOccurred())
+			oldRaw, err := json.Marshal(oldPod)
+			Expect(err).NotTo(HaveOccurred())
+
+			return pod, sendRequestAndGetResponse(&admissionv1.AdmissionRequest{
+				Namespace:   "default",
+				Operation:   admissionv1.Update,
+				SubResource: "ephemeralcontainers",
+				Object:      runtime.RawExtension{Raw: raw},
+				OldObject:   runtime.RawExtension{Raw: oldRaw},
+			}, rr, handler)
+		}
+
+		It("wraps the debug container command and inherits the target environment", func() {
+			pod, responseBody := sendEphemeralContainerRequest(injectedPod(map[string]string{
+				"operator.1password.io/inject":           "app",
+				"operator.1password.io/status":           "injected",
+				"operator.1password.io/inject-ephemeral": "true",
+			}))
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			debugger := patched.Spec.EphemeralContainers[0]
+			Expect(debugger.Command).To(Equal([]string{"/op/bin/op", "run", "--", "sh"}))
+			Expect(debugger.VolumeMounts).To(ContainElement(binVolumeMount))
+
+			var envNames []string
+			for _, env := range debugger.Env {
+				envNames = append(envNames, env.Name)
+			}
+			Expect(envNames).To(ConsistOf("OP_SERVICE_ACCOUNT_TOKEN", "DB_PASSWORD",
+				"OP_INTEGRATION_NAME", "OP_INTEGRATION_ID", "OP_INTEGRATION_BUILDNUMBER"))
+			Expect(patched.Spec.Containers).To(Equal(pod.Spec.Containers))
+		})
+
+		It("mounts the OP CLI image volume of the target without a subPath", func() {
+			oldPod := injectedPod(map[string]string{
+				"operator.1password.io/inject":           "app",
+				"operator.1password.io/status":           "injected",
+				"operator.1password.io/inject-ephemeral": "true",
+			})
+			oldPod.Spec.Volumes = []corev1.Volume{{
+				Name: "op-bin",
+				VolumeSource: corev1.VolumeSource{
+					Image: &corev1.ImageVolumeSource{Reference: "1password/op:2"},
+				},
+			}}
+			oldPod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+				{Name: "op-bin", MountPath: "/op/bin/", SubPath: "usr/local/bin", ReadOnly: true},
+			}
+			pod, responseBody := sendEphemeralContainerRequest(oldPod)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			debugger := patched.Spec.EphemeralContainers[0]
+			Expect(debugger.Command).To(Equal([]string{"/op/image/usr/local/bin/op", "run", "--", "sh"}))
+			Expect(debugger.VolumeMounts).To(Equal([]corev1.VolumeMount{
+				{Name: "op-bin", MountPath: "/op/image/", ReadOnly: true},
+			}))
+			for _, mount := range debugger.VolumeMounts {
+				Expect(mount.SubPath).To(BeEmpty())
+			}
+		})
+
+		It("does not patch debug containers without the opt-in annotation", func() {
+			_, responseBody := sendEphemeralContainerRequest(injectedPod(map[string]string{
+				"operator.1password.io/inject": "app",
+				"operator.1password.io/status": "injected",
+			}))
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+		})
+
+		It("does not patch debug containers of a pod without the op-bin volume", func() {
+			oldPod := injectedPod(map[string]string{
+				"operator.1password.io/inject-ephemeral": "true",
+			})
+			oldPod.Spec.Volumes = nil
+			_, responseBody := sendEphemeralContainerRequest(oldPod)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+		})
+
+		It("does not patch ephemeral containers added by a previous request", func() {
+			pod, _ := sendEphemeralContainerRequest(injectedPod(map[string]string{
+				"operator.1password.io/inject-ephemeral": "true",
+			}))
+			rr = httptest.NewRecorder()
+
+			raw, err := json.Marshal(pod)
+			Expect(err).NotTo(HaveOccurred())
+			responseBody := sendRequestAndGetResponse(&admissionv1.AdmissionRequest{
+				Namespace:   "default",
+				Operation:   admissionv1.Update,
+				SubResource: "ephemeralcontainers",
+				Object:      runtime.RawExtension{Raw: raw},
+				OldObject:   runtime.RawExtension{Raw: raw},
+			}, rr, handler)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+		})
+	})
+
+	Context("renders secret files", func() {
+		newPod := func(annotations map[string]string) corev1.Pod {
+			return testPod(annotations, corev1.Container{
+				Name:    "app",
+				Command: []string{"java", "-jar", "app.jar"},
+				Env: []corev1.EnvVar{
+					{Name: "OP_CONNECT_HOST", Value: "http://onepassword-connect:8080"},
+					{Name: "OP_CONNECT_TOKEN", ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "connect-token"},
+							Key:                  "token",
+						},
+					}},
+				},
+				VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+			}, testContainer("proxy"))
+		}
+
+		It("renders the ConfigMap templates into an in-memory volume mounted in the injected containers", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject":                 "app",
+				"operator.1password.io/inject-files-configmap": "app-config-templates",
+				"operator.1password.io/inject-files-path":      "/etc/app",
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Volumes).To(HaveLen(4))
+			Expect(patched.Spec.Volumes[1].ConfigMap.Name).To(Equal("app-config-templates"))
+			Expect(patched.Spec.Volumes[2].Name).To(Equal("op-secrets"))
+			Expect(patched.Spec.Volumes[2].EmptyDir.Medium).To(Equal(corev1.StorageMediumMemory))
+			Expect(patched.Spec.Volumes[3].Name).To(Equal("op-config"))
+
+			Expect(patched.Spec.InitContainers).To(HaveLen(2))
+			Expect(patched.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+			renderer := patched.Spec.InitContainers[1]
+			Expect(renderer.Name).To(Equal("op-inject-files"))
+			Expect(renderer.Image).To(Equal("1password/op:2"))
+			Expect(renderer.Command[2]).To(ContainSubstring("op inject"))
+			Expect(renderer.Env).To(ContainElements(pod.Spec.Containers[0].Env))
+
+			app := patched.Spec.Containers[0]
+			Expect(app.Command).To(Equal([]string{"/op/bin/op", "run", "--", "java", "-jar", "app.jar"}))
+			Expect(app.VolumeMounts).To(ConsistOf(
+				corev1.VolumeMount{Name: "data", MountPath: "/data"},
+				corev1.VolumeMount{Name: "op-secrets", MountPath: "/etc/app", ReadOnly: true},
+				binVolumeMount,
+			))
+			Expect(patched.Spec.Containers[1].VolumeMounts).To(BeEmpty())
+		})
+
+		It("mounts the secret files in the default path", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject":                 "app",
+				"operator.1password.io/inject-files-configmap": "app-config-templates",
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Containers[0].VolumeMounts).To(ContainElement(
+				corev1.VolumeMount{Name: "op-secrets", MountPath: "/op/secrets", ReadOnly: true}))
+		})
+
+		It("rejects a relative mount path", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject":                 "app",
+				"operator.1password.io/inject-files-configmap": "app-config-templates",
+				"operator.1password.io/inject-files-path":      "etc/app",
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Allowed).To(BeFalse())
+			Expect(responseBody.Result.Message).To(ContainSubstring("must be an absolute path"))
+		})
+
+		It("rejects a mount path the container already mounts a volume at", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject":                 "app",
+				"operator.1password.io/inject-files-configmap": "app-config-templates",
+				"operator.1password.io/inject-files-path":      "/data/",
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Allowed).To(BeFalse())
+			Expect(responseBody.Result.Message).To(ContainSubstring("the volume data is already mounted at /data, set operator.1password.io/inject-files-path to another path"))
+		})
+	})
+
+	Context("injects in files mode", func() {
+		It("renders a dotenv file without changing the container command", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":      "app",
+				"operator.1password.io/inject-mode": "files",
+			}, corev1.Container{
+				Name:  "app",
+				Image: "gcr.io/distroless/app",
+				Env: []corev1.EnvVar{
+					{Name: "OP_SERVICE_ACCOUNT_TOKEN", Value: "token"},
+					{Name: "DB_USERNAME", Value: "op://vault/db/username"},
+					{Name: "DB_PASSWORD", Value: "op://vault/db/password"},
+					{Name: "LOG_LEVEL", Value: "debug"},
+				},
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Volumes).To(HaveLen(3))
+			Expect(patched.Spec.Volumes[0].Name).To(Equal("op-bin"))
+			Expect(patched.Spec.Volumes[1].Name).To(Equal("op-secrets"))
+			Expect(patched.Spec.Volumes[2].Name).To(Equal("op-config"))
+
+			Expect(patched.Spec.InitContainers).To(HaveLen(2))
+			Expect(patched.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+			renderer := patched.Spec.InitContainers[1]
+			Expect(renderer.Name).To(Equal("op-inject-files"))
+			Expect(renderer.Command[2]).To(ContainSubstring(`/op/bin/op inject --force --file-mode=0644 --out-file "/op/secrets/app.env"`))
+			Expect(renderer.VolumeMounts).To(ContainElement(binVolumeMount))
+			Expect(renderer.Env).To(ContainElements(
+				corev1.EnvVar{Name: "OP_SERVICE_ACCOUNT_TOKEN", Value: "token"},
+				corev1.EnvVar{Name: "OP_DOTENV_TEMPLATE_0", Value: "DB_USERNAME={{ op://vault/db/username }}\nDB_PASSWORD={{ op://vault/db/password }}\n"},
+			))
+
+			app := patched.Spec.Containers[0]
+			Expect(app.Command).To(BeEmpty())
+			Expect(app.Env).To(Equal(pod.Spec.Containers[0].Env))
+			Expect(app.VolumeMounts).To(ConsistOf(corev1.VolumeMount{Name: "op-secrets", MountPath: "/op/secrets", ReadOnly: true}))
+			Expect(patched.Annotations).To(HaveKeyWithValue("operator.1password.io/status", "injected"))
+		})
+
+		It("rejects an unknown injection mode", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":      "app",
+				"operator.1password.io/inject-mode": "magic",
+			}, testContainer("app"))
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Allowed).To(BeFalse())
+			Expect(responseBody.Result.Message).To(ContainSubstring("invalid operator.1password.io/inject-mode"))
+		})
+	})
+
+	Context("loads an env file from a ConfigMap", func() {
+		newPod := func(annotations map[string]string) corev1.Pod {
+			return testPod(annotations, corev1.Container{Name: "app", Command: []string{"npm", "start"}})
+		}
+
+		It("mounts the env file and passes it to op run", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject":                    "app",
+				"operator.1password.io/inject-env-file-configmap": "app-secrets",
+				"operator.1password.io/inject-env-file-key":       "app.env",
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Volumes).To(ContainElement(corev1.Volume{
+				Name: "op-env-file",
+				VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "app-secrets"},
+						Items:                []corev1.KeyToPath{{Key: "app.env", Path: "app.env"}},
+					},
+				},
+			}))
+
+			app := patched.Spec.Containers[0]
+			Expect(app.Command).To(Equal([]string{"/op/bin/op", "run", "--env-file=/op/env/app.env", "--", "npm", "start"}))
+			Expect(app.VolumeMounts).To(ContainElement(corev1.VolumeMount{Name: "op-env-file", MountPath: "/op/env/", ReadOnly: true}))
+		})
+
+		It("uses the .env key by default", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject":                    "app",
+				"operator.1password.io/inject-env-file-configmap": "app-secrets",
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Containers[0].Command).To(Equal([]string{"/op/bin/op", "run", "--env-file=/op/env/.env", "--", "npm", "start"}))
+		})
+
+		It("rejects an env file in files mode", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject":                    "app",
+				"operator.1password.io/inject-mode":               "files",
+				"operator.1password.io/inject-env-file-configmap": "app-secrets",
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Allowed).To(BeFalse())
+		})
+	})
+
+	Context("maps secrets declared in annotations", func() {
+		It("adds the mapped variables to the container before wrapping it", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":                   "app,worker",
+				"secrets.operator.1password.io/app.DB_PASSWORD":  "op://vault/db/password",
+				"secrets.operator.1password.io/app.DB_USERNAME":  "op://vault/db/username",
+				"secrets.operator.1password.io/app.LOG_LEVEL":    "op://vault/app/log-level",
+				"secrets.operator.1password.io/worker.API_TOKEN": "op://vault/api/token",
+			}, testContainer("app", corev1.EnvVar{Name: "LOG_LEVEL", Value: "debug"}), testContainer("worker"), testContainer("proxy"))
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Containers[0].Env[:3]).To(Equal([]corev1.EnvVar{
+				{Name: "LOG_LEVEL", Value: "debug"},
+				{Name: "DB_PASSWORD", Value: "op://vault/db/password"},
+				{Name: "DB_USERNAME", Value: "op://vault/db/username"},
+			}))
+			Expect(patched.Spec.Containers[0].Command).To(Equal([]string{"/op/bin/op", "run", "--", "app"}))
+			Expect(patched.Spec.Containers[1].Env[0]).To(Equal(corev1.EnvVar{Name: "API_TOKEN", Value: "op://vault/api/token"}))
+			Expect(patched.Spec.Containers[1].Env).To(HaveLen(4))
+			Expect(patched.Spec.Containers[2].Env).To(BeEmpty())
+		})
+
+		It("selects containers with mapped secrets in auto mode", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":                   "auto",
+				"secrets.operator.1password.io/worker.API_TOKEN": "op://vault/api/token",
+			}, testContainer("app"), testContainer("worker"))
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Containers[0].Command).To(Equal([]string{"app"}))
+			Expect(patched.Spec.Containers[1].Command).To(Equal([]string{"/op/bin/op", "run", "--", "worker"}))
+		})
+
+		It("rejects a mapping that is not a secret reference", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":                "app",
+				"secrets.operator.1password.io/app.API_TOKEN": "plain-text",
+			}, testContainer("app"))
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Allowed).To(BeFalse())
+			Expect(responseBody.Result.Message).To(ContainSubstring("is not a secret reference"))
+		})
+	})
+
+	Context("configures the OP CLI per container", func() {
+		It("copies every OP CLI version into its own volume", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":                 "app,worker,reporter",
+				"operator.1password.io/version":                "2.30.0",
+				"operator.1password.io/version.worker":         "2.18.0",
+				"operator.1password.io/version.reporter":       "2.18.0",
+				"operator.1password.io/account":                "my-team.1password.com",
+				"operator.1password.io/no-masking.worker":      "true",
+				"operator.1password.io/account.reporter":       "reports.1password.com",
+				"operator.1password.io/no-masking":             "false",
+				"operator.1password.io/no-masking.reporter":    "true",
+				"operator.1password.io/version.not-injected":   "2.0.0",
+				"operator.1password.io/account.not-injected":   "other.1password.com",
+				"operator.1password.io/inject-files-configmap": "app-templates",
+			}, testContainer("app"), testContainer("worker"), testContainer("reporter"), testContainer("not-injected"))
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers).To(HaveLen(3))
+			Expect(patched.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+			Expect(patched.Spec.InitContainers[0].Image).To(Equal("1password/op:2.30.0"))
+			Expect(patched.Spec.InitContainers[0].VolumeMounts[0].Name).To(Equal("op-bin"))
+			Expect(patched.Spec.InitContainers[1].Name).To(Equal("copy-op-bin-2-18-0"))
+			Expect(patched.Spec.InitContainers[1].Image).To(Equal("1password/op:2.18.0"))
+			Expect(patched.Spec.InitContainers[1].VolumeMounts[0].Name).To(Equal("op-bin-2-18-0"))
+			// the secret files are rendered with the pod version
+			Expect(patched.Spec.InitContainers[2].Name).To(Equal("op-inject-files"))
+			Expect(patched.Spec.InitContainers[2].Image).To(Equal("1password/op:2.30.0"))
+
+			var volumes []string
+			for _, volume := range patched.Spec.Volumes {
+				volumes = append(volumes, volume.Name)
+			}
+			Expect(volumes).To(Equal([]string{"op-bin", "op-bin-2-18-0", "op-secrets-templates", "op-secrets", "op-config"}))
+
+			app := patched.Spec.Containers[0]
+			Expect(app.Command).To(Equal([]string{"/op/bin/op", "run", "--account=my-team.1password.com", "--", "app"}))
+			Expect(app.VolumeMounts).To(ContainElement(corev1.VolumeMount{Name: "op-bin", MountPath: "/op/bin/", ReadOnly: true}))
+
+			worker := patched.Spec.Containers[1]
+			Expect(worker.Command).To(Equal([]string{"/op/bin/op", "run", "--account=my-team.1password.com", "--no-masking", "--", "worker"}))
+			Expect(worker.VolumeMounts).To(ContainElement(corev1.VolumeMount{Name: "op-bin-2-18-0", MountPath: "/op/bin/", ReadOnly: true}))
+
+			reporter := patched.Spec.Containers[2]
+			Expect(reporter.Command).To(Equal([]string{"/op/bin/op", "run", "--account=reports.1password.com", "--no-masking", "--", "reporter"}))
+			Expect(reporter.VolumeMounts).To(ContainElement(corev1.VolumeMount{Name: "op-bin-2-18-0", MountPath: "/op/bin/", ReadOnly: true}))
+
+			Expect(patched.Spec.Containers[3].Command).To(Equal([]string{"not-injected"}))
+		})
+
+		It("does not copy the pod version when no container runs it", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":      "app",
+				"operator.1password.io/version.app": "2-beta",
+			}, testContainer("app"))
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers).To(HaveLen(1))
+			Expect(patched.Spec.InitContainers[0].Name).To(Equal("copy-op-bin-2-beta"))
+			Expect(patched.Spec.Volumes).To(HaveLen(1))
+			Expect(patched.Spec.Volumes[0].Name).To(Equal("op-bin-2-beta"))
+		})
+
+		It("rejects an invalid version", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":      "app",
+				"operator.1password.io/version.app": "2 && sh",
+			}, testContainer("app"))
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Allowed).To(BeFalse())
+			Expect(responseBody.Result.Message).To(ContainSubstring("invalid OP CLI version"))
+		})
+
+		It("rejects versions whose init containers can't be named after them", func() {
+			newPod := func(versions map[string]string) corev1.Pod {
+				annotations := map[string]string{"operator.1password.io/inject": "app,worker"}
+				for container, version := range versions {
+					annotations["operator.1password.io/version."+container] = version
+				}
+				return testPod(annotations, testContainer("app"), testContainer("worker"))
+			}
+
+			responseBody := sendPodAndGetResponse(newPod(map[string]string{"app": "2." + strings.Repeat("0", 60)}), rr, handler)
+			Expect(responseBody.Allowed).To(BeFalse())
+			Expect(responseBody.Result.Message).To(ContainSubstring("invalid operator.1password.io/version.app"))
+			Expect(responseBody.Result.Message).To(ContainSubstring("must be no more than 63 characters"))
+
+			rr = httptest.NewRecorder()
+			responseBody = sendPodAndGetResponse(newPod(map[string]string{"app": "2.30", "worker": "2-30"}), rr, handler)
+			Expect(responseBody.Allowed).To(BeFalse())
+			Expect(responseBody.Result.Message).To(Equal(`invalid operator.1password.io/version.worker "2-30": its init container would have the same name, copy-op-bin-2-30, as the one of version "2.30"`))
+
+			rr = httptest.NewRecorder()
+			responseBody = sendPodAndGetResponse(newPod(map[string]string{"app": "2.30", "worker": "2.30"}), rr, handler)
+			Expect(responseBody.Allowed).To(BeTrue())
+		})
+
+		It("rejects an invalid no-masking value", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":         "app",
+				"operator.1password.io/no-masking.app": "sometimes",
+			}, testContainer("app"))
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Allowed).To(BeFalse())
+		})
+	})
+
+	Context("pulls the OP CLI image from the configured registry", func() {
+		const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+		var cliImageHandler http.HandlerFunc
+
+		BeforeAll(func() {
+			secretInjector := SecretInjector{
+				CLIImage: CLIImage{
+					Registry:    "registry.example.com",
+					Repository:  "mirror/op",
+					Digests:     map[string]string{"2.30.0": digest},
+					PullPolicy:  corev1.PullAlways,
+					PullSecrets: []string{"mirror-credentials"},
+				},
+			}
+			cliImageHandler = secretInjector.Serve
+		})
+
+		newPod := func(annotations map[string]string, pullSecrets ...corev1.LocalObjectReference) corev1.Pod {
+			pod := testPod(annotations, testContainer("app"))
+			pod.Spec.ImagePullSecrets = pullSecrets
+			return pod
+		}
+
+		It("uses the configured image, digest and pull policy", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject":                 "app",
+				"operator.1password.io/version":                "2.30.0",
+				"operator.1password.io/inject-files-configmap": "app-templates",
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, cliImageHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers).To(HaveLen(2))
+			for _, c := range patched.Spec.InitContainers {
+				Expect(c.Image).To(Equal("registry.example.com/mirror/op:2.30.0@" + digest))
+				Expect(c.ImagePullPolicy).To(Equal(corev1.PullAlways))
+			}
+			Expect(patched.Spec.ImagePullSecrets).To(Equal([]corev1.LocalObjectReference{{Name: "mirror-credentials"}}))
+		})
+
+		It("does not pin versions without a digest", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject": "app",
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, cliImageHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers[0].Image).To(Equal("registry.example.com/mirror/op:2"))
+		})
+
+		It("keeps the pod's image pull secrets", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject": "app",
+			}, corev1.LocalObjectReference{Name: "app-credentials"})
+			responseBody := sendPodAndGetResponse(pod, rr, cliImageHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.ImagePullSecrets).To(Equal([]corev1.LocalObjectReference{{Name: "app-credentials"}, {Name: "mirror-credentials"}}))
+
+			rr = httptest.NewRecorder()
+			responseBody = sendPodAndGetResponse(patched, rr, cliImageHandler)
+			Expect(responseBody.Patch).To(BeNil())
+		})
+
+		It("pulls 1password/op from Docker Hub by default", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject": "app",
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers[0].Image).To(Equal("1password/op:2"))
+			Expect(patched.Spec.InitContainers[0].ImagePullPolicy).To(Equal(corev1.PullIfNotPresent))
+			Expect(patched.Spec.ImagePullSecrets).To(BeEmpty())
+		})
+
+		It("parses the image digests", func() {
+			digests, err := ParseImageDigests("2=" + digest + ", 2.30.0=" + digest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digests).To(Equal(map[string]string{"2": digest, "2.30.0": digest}))
+
+			_, err = ParseImageDigests(digest)
+			Expect(err).To(HaveOccurred())
+			_, err = ParseImageDigests("2=sha256:abc")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("parses the pull policy", func() {
+			policy, err := ParsePullPolicy("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(policy).To(Equal(corev1.PullIfNotPresent))
+
+			_, err = ParsePullPolicy("always")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("copies the OP CLI bundled in the injector image", func() {
+		var bundledHandler http.HandlerFunc
+
+		BeforeAll(func() {
+			secretInjector := SecretInjector{
+				CLIImage: CLIImage{
+					Bundled: &BundledCLI{
+						Image:   "1password/kubernetes-secrets-injector:1.1.0",
+						Path:    "/usr/local/bin/op",
+						Version: "2.32.0",
+						SHA256:  "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+					},
+				},
+			}
+			bundledHandler = secretInjector.Serve
+		})
+
+		It("copies the bundled binary without a shell for the versions it provides", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":         "app,worker,legacy",
+				"operator.1password.io/version.worker": "2.32",
+				"operator.1password.io/version.legacy": "2.18.0",
+			}, testContainer("app"), testContainer("worker"), testContainer("legacy"))
+			responseBody := sendPodAndGetResponse(pod, rr, bundledHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers).To(HaveLen(3))
+			for _, c := range patched.Spec.InitContainers[:2] {
+				Expect(c.Image).To(Equal("1password/kubernetes-secrets-injector:1.1.0"))
+				Expect(c.Command).To(Equal([]string{"/injector", "copy-op",
+					"-source=/usr/local/bin/op",
+					"-destination=/op/bin/op",
+					"-sha256=0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"}))
+			}
+			Expect(patched.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+			Expect(patched.Spec.InitContainers[1].Name).To(Equal("copy-op-bin-2-32"))
+
+			// versions that are not bundled are still pulled from the OP CLI image
+			legacy := patched.Spec.InitContainers[2]
+			Expect(legacy.Name).To(Equal("copy-op-bin-2-18-0"))
+			Expect(legacy.Image).To(Equal("1password/op:2.18.0"))
+			Expect(legacy.Command[0]).To(Equal("sh"))
+		})
+
+		It("renders the secret files without a shell", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":                 "app",
+				"operator.1password.io/inject-mode":            "files",
+				"operator.1password.io/inject-files-configmap": "app-templates",
+			}, corev1.Container{Name: "app", Image: "app", Env: secretEnv})
+			responseBody := sendPodAndGetResponse(pod, rr, bundledHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers).To(HaveLen(2))
+			renderer := patched.Spec.InitContainers[1]
+			Expect(renderer.Name).To(Equal("op-inject-files"))
+			Expect(renderer.Image).To(Equal("1password/kubernetes-secrets-injector:1.1.0"))
+			Expect(renderer.Command).To(Equal([]string{"/injector", "inject-files",
+				"-op=/op/bin/op",
+				"-destination=/op/secrets/",
+				"-templates=/op/templates/",
+				"-dotenv=app.env=OP_DOTENV_TEMPLATE_0"}))
+			Expect(renderer.Env).To(ContainElement(corev1.EnvVar{Name: "OP_DOTENV_TEMPLATE_0", Value: "DB_PASSWORD={{ op://vault/db/password }}\n"}))
+		})
+	})
+
+	Context("mounts the OP CLI from an image volume", func() {
+		var imageVolumeHandler http.HandlerFunc
+
+		BeforeAll(func() {
+			secretInjector := SecretInjector{ImageVolumes: true}
+			imageVolumeHandler = secretInjector.Serve
+		})
+
+		It("replaces the copy of the binary with an image volume", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":         "app,worker",
+				"operator.1password.io/version.worker": "2.18.0",
+			}, testContainer("app"), testContainer("worker"))
+			responseBody := sendPodAndGetResponse(pod, rr, imageVolumeHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers).To(BeEmpty())
+			Expect(patched.Spec.Volumes).To(Equal([]corev1.Volume{
+				{
+					Name: "op-bin",
+					VolumeSource: corev1.VolumeSource{
+						Image: &corev1.ImageVolumeSource{Reference: "1password/op:2", PullPolicy: corev1.PullIfNotPresent},
+					},
+				},
+				{
+					Name: "op-bin-2-18-0",
+					VolumeSource: corev1.VolumeSource{
+						Image: &corev1.ImageVolumeSource{Reference: "1password/op:2.18.0", PullPolicy: corev1.PullIfNotPresent},
+					},
+				},
+			}))
+
+			app := patched.Spec.Containers[0]
+			Expect(app.Command).To(Equal([]string{"/op/bin/op", "run", "--", "app"}))
+			Expect(app.VolumeMounts).To(Equal([]corev1.VolumeMount{{Name: "op-bin", MountPath: "/op/bin/", SubPath: "usr/local/bin", ReadOnly: true}}))
+			Expect(patched.Spec.Containers[1].VolumeMounts).To(Equal([]corev1.VolumeMount{{Name: "op-bin-2-18-0", MountPath: "/op/bin/", SubPath: "usr/local/bin", ReadOnly: true}}))
+		})
+
+		It("mounts the injector image when it bundles the version", func() {
+			secretInjector := SecretInjector{
+				ImageVolumes: true,
+				CLIImage: CLIImage{
+					Bundled: &BundledCLI{Image: "1password/kubernetes-secrets-injector:1.1.0", Path: "/usr/local/bin/op", Version: "2.32.0"},
+				},
+			}
+			pod := testPod(map[string]string{"operator.1password.io/inject": "app"}, testContainer("app"))
+			responseBody := sendPodAndGetResponse(pod, rr, secretInjector.Serve)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Volumes[0].Image.Reference).To(Equal("1password/kubernetes-secrets-injector:1.1.0"))
+			Expect(patched.Spec.Containers[0].VolumeMounts[0].SubPath).To(Equal("usr/local/bin"))
+		})
+
+		When("probing the API server", func() {
+			var client *k8stestclient.Clientset
+			var previousClient kubernetes.Interface
+
+			BeforeEach(func() {
+				previousClient = k8sClient
+				client = k8stestclient.NewSimpleClientset()
+				k8sClient = client
+			})
+
+			AfterEach(func() {
+				k8sClient = previousClient
+			})
+
+			It("detects that image volumes are supported", func() {
+				Expect(ImageVolumesSupported(context.Background(), "secrets-injector", CLIImage{})).To(BeTrue())
+			})
+
+			It("detects that the ImageVolume feature is disabled", func() {
+				client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod).DeepCopy()
+					pod.Spec.Volumes[0].Image = nil
+					return true, pod, nil
+				})
+				Expect(ImageVolumesSupported(context.Background(), "secrets-injector", CLIImage{})).To(BeFalse())
+			})
+
+			It("falls back when the probe pod is rejected", func() {
+				client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("spec.volumes[0]: Required value: must specify a volume type")
+				})
+				Expect(ImageVolumesSupported(context.Background(), "secrets-injector", CLIImage{})).To(BeFalse())
+			})
+		})
+	})
+
+	Context("verifies the OP CLI binary", func() {
+		const amd64Checksum = "1111111111111111111111111111111111111111111111111111111111111111"
+		const arm64Checksum = "2222222222222222222222222222222222222222222222222222222222222222"
+		checksums := map[string][]string{"2.30.0": {amd64Checksum, arm64Checksum}}
+
+		newPod := func() corev1.Pod {
+			return testPod(map[string]string{
+				"operator.1password.io/inject":         "app,worker",
+				"operator.1password.io/version":        "2.30.0",
+				"operator.1password.io/version.worker": "2.18.0",
+			}, testContainer("app"), testContainer("worker"))
+		}
+
+		It("checks the copied binary against the allowed checksums of its version", func() {
+			secretInjector := SecretInjector{CLIImage: CLIImage{Checksums: checksums}}
+			pod := newPod()
+			responseBody := sendPodAndGetResponse(pod, rr, secretInjector.Serve)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			verified := patched.Spec.InitContainers[0]
+			Expect(verified.Name).To(Equal("copy-op-bin"))
+			Expect(verified.TerminationMessagePolicy).To(Equal(corev1.TerminationMessageFallbackToLogsOnError))
+			Expect(verified.Command[:2]).To(Equal([]string{"sh", "-c"}))
+			Expect(verified.Command[2]).To(ContainSubstring("sha256sum /op/bin/.op"))
+			Expect(verified.Command[2]).To(ContainSubstring(amd64Checksum + "|" + arm64Checksum + ") mv /op/bin/.op /op/bin/op ;;"))
+			Expect(verified.Command[2]).To(ContainSubstring("exit 1"))
+
+			// versions without checksums are copied as they are
+			Expect(patched.Spec.InitContainers[1].Command).To(Equal([]string{"sh", "-c", "cp /usr/local/bin/op /op/bin/"}))
+		})
+
+		It("passes the allowed checksums to the copier of the bundled binary", func() {
+			secretInjector := SecretInjector{
+				CLIImage: CLIImage{
+					Checksums: checksums,
+					Bundled: &BundledCLI{
+						Image:   "1password/kubernetes-secrets-injector:1.1.0",
+						Path:    "/usr/local/bin/op",
+						Version: "2.30.0",
+						SHA256:  amd64Checksum,
+					},
+				},
+			}
+			pod := newPod()
+			responseBody := sendPodAndGetResponse(pod, rr, secretInjector.Serve)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers[0].Command).To(ContainElement("-sha256=" + amd64Checksum + "," + arm64Checksum))
+		})
+
+		It("renders the secret files with the verified binary in files mode", func() {
+			secretInjector := SecretInjector{ImageVolumes: true, CLIImage: CLIImage{Checksums: checksums}}
+			pod := newPod()
+			pod.Annotations["operator.1password.io/inject-mode"] = "files"
+			pod.Annotations["operator.1password.io/inject-files-configmap"] = "app-templates"
+			responseBody := sendPodAndGetResponse(pod, rr, secretInjector.Serve)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers).To(HaveLen(2))
+			verified := patched.Spec.InitContainers[0]
+			Expect(verified.Name).To(Equal("copy-op-bin"))
+			Expect(verified.Command[2]).To(ContainSubstring(amd64Checksum + "|" + arm64Checksum + ") mv /op/bin/.op /op/bin/op ;;"))
+
+			renderer := patched.Spec.InitContainers[1]
+			Expect(renderer.Name).To(Equal("op-inject-files"))
+			Expect(renderer.VolumeMounts).To(ContainElement(binVolumeMount))
+			Expect(renderer.Command[2]).To(ContainSubstring("/op/bin/op inject"))
+			Expect(strings.ReplaceAll(renderer.Command[2], "/op/bin/op inject", "")).NotTo(ContainSubstring("op inject"))
+			Expect(patched.Spec.Volumes[0].Name).To(Equal("op-bin"))
+			Expect(patched.Spec.Volumes[0].EmptyDir).NotTo(BeNil())
+		})
+
+		It("copies the versions with checksums instead of mounting an image volume", func() {
+			secretInjector := SecretInjector{ImageVolumes: true, CLIImage: CLIImage{Checksums: checksums}}
+			pod := newPod()
+			responseBody := sendPodAndGetResponse(pod, rr, secretInjector.Serve)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers).To(HaveLen(1))
+			Expect(patched.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+			Expect(patched.Spec.Volumes[0].EmptyDir).NotTo(BeNil())
+			Expect(patched.Spec.Volumes[1].Image).NotTo(BeNil())
+			Expect(patched.Spec.Containers[0].VolumeMounts[0].SubPath).To(BeEmpty())
+			Expect(patched.Spec.Containers[1].VolumeMounts[0].SubPath).To(Equal("usr/local/bin"))
+		})
+
+		It("parses the allowed checksums", func() {
+			parsed, err := ParseChecksums("2.30.0=" + amd64Checksum + ", 2.30.0=" + strings.ToUpper(arm64Checksum))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(Equal(checksums))
+
+			_, err = ParseChecksums("2.30.0=sha256:" + amd64Checksum)
+			Expect(err).To(HaveOccurred())
+			_, err = ParseChecksums(amd64Checksum)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("complies with the restricted Pod Security Standard", func() {
+		var resourcesHandler http.HandlerFunc
+
+		BeforeAll(func() {
+			resources, err := ParseResources("10m", "32Mi", "", "128Mi")
+			Expect(err).NotTo(HaveOccurred())
+			secretInjector := SecretInjector{InitContainerResources: resources}
+			resourcesHandler = secretInjector.Serve
+		})
+
+		It("injects init containers that are compliant with the restricted profile", func() {
+			runAsNonRoot := true
+			allowPrivilegeEscalation := false
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"operator.1password.io/inject":                 "app",
+						"operator.1password.io/inject-files-configmap": "app-templates",
+					},
+				},
+				Spec: corev1.PodSpec{
+					SecurityContext: &corev1.PodSecurityContext{
+						RunAsNonRoot:   &runAsNonRoot,
+						SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:    "app",
+							Command: []string{"app"},
+							Env:     secretEnv,
+							SecurityContext: &corev1.SecurityContext{
+								AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+								Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+							},
+						},
+					},
+				},
+			}
+			Expect(restrictedProfileViolations(pod)).To(BeEmpty())
+
+			responseBody := sendPodAndGetResponse(pod, rr, resourcesHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers).To(HaveLen(2))
+			Expect(restrictedProfileViolations(patched)).To(BeEmpty())
+			for _, c := range patched.Spec.InitContainers {
+				Expect(*c.SecurityContext.ReadOnlyRootFilesystem).To(BeTrue())
+				Expect(*c.SecurityContext.RunAsUser).NotTo(BeZero())
+			}
+		})
+
+		It("sets the configured resources on the injected init containers", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject": "app",
+			}, testContainer("app"))
+			responseBody := sendPodAndGetResponse(pod, rr, resourcesHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			resources := patched.Spec.InitContainers[0].Resources
+			Expect(resources.Requests.Cpu().String()).To(Equal("10m"))
+			Expect(resources.Requests.Memory().String()).To(Equal("32Mi"))
+			Expect(resources.Limits.Memory().String()).To(Equal("128Mi"))
+			Expect(resources.Limits).NotTo(HaveKey(corev1.ResourceCPU))
+		})
+
+		It("rejects invalid resources", func() {
+			_, err := ParseResources("a lot", "", "", "")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("enforces the credentials policy", func() {
+		serviceAccountToken := corev1.EnvVar{
+			Name: "OP_SERVICE_ACCOUNT_TOKEN",
+			ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "op-service-account"},
+				Key:                  "token",
+			}},
+		}
+
+		newPod := func(annotations map[string]string, app, worker corev1.Container) corev1.Pod {
+			annotations["operator.1password.io/inject"] = "app,worker"
+			app.Name, app.Command = "app", []string{"app"}
+			worker.Name, worker.Command = "worker", []string{"worker"}
+			app.Env = append(app.Env, secretEnv...)
+			worker.Env = append(worker.Env, secretEnv...)
+			return testPod(annotations, app, worker)
+		}
+
+		sendWithPolicy := func(policy CredentialsPolicy, pod corev1.Pod) *admissionv1.AdmissionResponse {
+			secretInjector := SecretInjector{CredentialsPolicy: policy}
+			return sendPodAndGetResponse(pod, rr, secretInjector.Serve)
+		}
+
+		It("denies pods with a container without credentials", func() {
+			pod := newPod(map[string]string{}, corev1.Container{Env: []corev1.EnvVar{serviceAccountToken}}, corev1.Container{})
+			responseBody := sendWithPolicy(CredentialsPolicyDeny, pod)
+			Expect(responseBody.Allowed).To(BeFalse())
+			Expect(responseBody.Result.Message).To(Equal("no 1Password CLI credentials in container(s) worker: set OP_CONNECT_HOST and OP_CONNECT_TOKEN, or OP_SERVICE_ACCOUNT_TOKEN"))
+		})
+
+		It("admits pods with a container without credentials with a warning", func() {
+			pod := newPod(map[string]string{}, corev1.Container{Env: []corev1.EnvVar{{Name: "OP_CONNECT_HOST", Value: "http://connect:8080"}}}, corev1.Container{})
+			responseBody := sendWithPolicy(CredentialsPolicyWarn, pod)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).NotTo(BeNil())
+			Expect(responseBody.Warnings).To(Equal([]string{"no 1Password CLI credentials in container(s) app, worker: set OP_CONNECT_HOST and OP_CONNECT_TOKEN, or OP_SERVICE_ACCOUNT_TOKEN"}))
+		})
+
+		It("admits pods without credentials with a warning by default", func() {
+			pod := newPod(map[string]string{}, corev1.Container{}, corev1.Container{})
+			responseBody := sendWithPolicy("", pod)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).NotTo(BeNil())
+			Expect(responseBody.Warnings).To(Equal([]string{"no 1Password CLI credentials in container(s) app, worker: set OP_CONNECT_HOST and OP_CONNECT_TOKEN, or OP_SERVICE_ACCOUNT_TOKEN"}))
+		})
+
+		It("admits pods without credentials silently when ignored", func() {
+			pod := newPod(map[string]string{}, corev1.Container{}, corev1.Container{})
+			responseBody := sendWithPolicy(CredentialsPolicyIgnore, pod)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).NotTo(BeNil())
+			Expect(responseBody.Warnings).To(BeEmpty())
+		})
+
+		It("admits pods whose containers provide credentials", func() {
+			connect := []corev1.EnvVar{{Name: "OP_CONNECT_HOST", Value: "http://connect:8080"}, {Name: "OP_CONNECT_TOKEN", Value: "token"}}
+			envFrom := []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "op-credentials"}}}}
+			pod := newPod(map[string]string{}, corev1.Container{Env: connect}, corev1.Container{EnvFrom: envFrom})
+			responseBody := sendWithPolicy(CredentialsPolicyDeny, pod)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Warnings).To(BeEmpty())
+		})
+
+		It("only requires one container to provide credentials in files mode", func() {
+			pod := newPod(map[string]string{"operator.1password.io/inject-mode": "files"},
+				corev1.Container{Env: []corev1.EnvVar{serviceAccountToken}}, corev1.Container{})
+			responseBody := sendWithPolicy(CredentialsPolicyDeny, pod)
+			Expect(responseBody.Allowed).To(BeTrue())
+
+			rr = httptest.NewRecorder()
+			pod = newPod(map[string]string{"operator.1password.io/inject-mode": "files"}, corev1.Container{}, corev1.Container{})
+			responseBody = sendWithPolicy(CredentialsPolicyDeny, pod)
+			Expect(responseBody.Allowed).To(BeFalse())
+			Expect(responseBody.Result.Message).To(ContainSubstring("to render the secret files"))
+		})
+
+		It("parses the credentials policy", func() {
+			policy, err := ParseCredentialsPolicy("Deny")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(policy).To(Equal(CredentialsPolicyDeny))
+
+			policy, err = ParseCredentialsPolicy("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(policy).To(Equal(CredentialsPolicyWarn))
+
+			_, err = ParseCredentialsPolicy("reject")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("wires the credentials from a Secret", func() {
+		fromSecret := func(name, secret, key string) corev1.EnvVar {
+			return corev1.EnvVar{
+				Name: name,
+				ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+					Key:                  key,
+				}},
+			}
+		}
+
+		newPod := func(annotations map[string]string) corev1.Pod {
+			annotations["operator.1password.io/inject"] = "app,worker"
+			connect := []corev1.EnvVar{
+				{Name: "OP_CONNECT_HOST", Value: "http://connect:8080"},
+				{Name: "OP_CONNECT_TOKEN", Value: "token"},
+			}
+			return testPod(annotations, testContainer("app", secretEnv...), testContainer("worker", append(connect, secretEnv...)...))
+		}
+
+		It("adds the Service Account token to the containers without credentials", func() {
+			pod := newPod(map[string]string{"operator.1password.io/credentials-secret": "op-service-account"})
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Containers[0].Env).To(ContainElement(fromSecret("OP_SERVICE_ACCOUNT_TOKEN", "op-service-account", "token")))
+			Expect(patched.Spec.Containers[1].Env).NotTo(ContainElement(HaveField("Name", "OP_SERVICE_ACCOUNT_TOKEN")))
+			Expect(patched.Spec.Containers[1].Env).To(ContainElement(corev1.EnvVar{Name: "OP_CONNECT_TOKEN", Value: "token"}))
+		})
+
+		It("adds the Connect host and token", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/credentials-secret": "op-connect",
+				"operator.1password.io/credentials-type":   "connect",
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Containers[0].Env).To(ContainElements(
+				fromSecret("OP_CONNECT_HOST", "op-connect", "host"),
+				fromSecret("OP_CONNECT_TOKEN", "op-connect", "token"),
+			))
+		})
+
+		It("uses the default credentials Secret unless the pod references its own", func() {
+			secretInjector := SecretInjector{Credentials: Credentials{Secret: "op-connect", Type: CredentialsConnect}}
+			pod := newPod(map[string]string{})
+			responseBody := sendPodAndGetResponse(pod, rr, secretInjector.Serve)
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Containers[0].Env).To(ContainElement(fromSecret("OP_CONNECT_TOKEN", "op-connect", "token")))
+
+			// the type of the default Secret doesn't apply to the Secret of the pod
+			rr = httptest.NewRecorder()
+			pod = newPod(map[string]string{"operator.1password.io/credentials-secret": "op-service-account"})
+			responseBody = sendPodAndGetResponse(pod, rr, secretInjector.Serve)
+			patched = applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Containers[0].Env).To(ContainElement(fromSecret("OP_SERVICE_ACCOUNT_TOKEN", "op-service-account", "token")))
+			Expect(patched.Spec.Containers[0].Env).NotTo(ContainElement(HaveField("Name", "OP_CONNECT_TOKEN")))
+		})
+
+		It("only gives the credentials to the secret files init container in files mode", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject-mode":        "files",
+				"operator.1password.io/credentials-secret": "op-service-account",
+			})
+			pod.Spec.Containers[1].Env = secretEnv
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+			Expect(patched.Spec.InitContainers[0].Env).To(BeEmpty())
+			Expect(patched.Spec.InitContainers[1].Name).To(Equal("op-inject-files"))
+			Expect(patched.Spec.InitContainers[1].Env).To(ContainElement(fromSecret("OP_SERVICE_ACCOUNT_TOKEN", "op-service-account", "token")))
+			Expect(patched.Spec.Containers[0].Env).To(Equal(secretEnv))
+		})
+
+		It("satisfies the credentials policy", func() {
+			secretInjector := SecretInjector{CredentialsPolicy: CredentialsPolicyDeny}
+			pod := newPod(map[string]string{"operator.1password.io/credentials-secret": "op-service-account"})
+			pod.Spec.Containers[1].Env = secretEnv
+			responseBody := sendPodAndGetResponse(pod, rr, secretInjector.Serve)
+			Expect(responseBody.Allowed).To(BeTrue())
+		})
+
+		It("rejects an invalid credentials reference", func() {
+			responseBody := sendPodAndGetResponse(newPod(map[string]string{
+				"operator.1password.io/credentials-secret": "op-connect",
+				"operator.1password.io/credentials-type":   "token",
+			}), rr, handler)
+			Expect(responseBody.Allowed).To(BeFalse())
+			Expect(responseBody.Result.Message).To(ContainSubstring("invalid operator.1password.io/credentials-type"))
+
+			rr = httptest.NewRecorder()
+			responseBody = sendPodAndGetResponse(newPod(map[string]string{
+				"operator.1password.io/credentials-secret": "OP Connect",
+			}), rr, handler)
+			Expect(responseBody.Allowed).To(BeFalse())
+		})
+	})
+
+	Context("warns about misconfigurations", func() {
+		// the missing credentials are warned about in their own context
+		warningsHandler := (&SecretInjector{CredentialsPolicy: CredentialsPolicyIgnore}).Serve
+
+		It("warns about containers that are not in the pod", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":                  "app,wroker",
+				"operator.1password.io/inject-exclude":          "sidecar",
+				"operator.1password.io/version.job":             "2.30.0",
+				"secrets.operator.1password.io/api.API_TOKEN":   "op://vault/api/token",
+				"secrets.operator.1password.io/app.DB_PASSWORD": "op://vault/db/password",
+			}, testContainer("app"))
+			responseBody := sendPodAndGetResponse(pod, rr, warningsHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+			Expect(responseBody.Warnings).To(Equal([]string{
+				"container api is referenced by the secret injection annotations but is not in the pod",
+				"container job is referenced by the secret injection annotations but is not in the pod",
+				"container sidecar is referenced by the secret injection annotations but is not in the pod",
+				"container wroker is referenced by the secret injection annotations but is not in the pod",
+			}))
+		})
+
+		It("warns even when no container is injected", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject": "ap",
+			}, testContainer("app"))
+			responseBody := sendPodAndGetResponse(pod, rr, warningsHandler)
+			Expect(responseBody.Patch).To(BeNil())
+			Expect(responseBody.Warnings).To(ConsistOf("container ap is referenced by the secret injection annotations but is not in the pod"))
+		})
+
+		It("warns about listed containers without secret references", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject": "app,worker",
+			}, testContainer("app", secretEnv...), corev1.Container{Name: "worker", Command: []string{"worker"}, Env: []corev1.EnvVar{{Name: "DB_PASSWORD", Value: "secret"}}})
+			responseBody := sendPodAndGetResponse(pod, rr, warningsHandler)
+			Expect(responseBody.Warnings).To(ConsistOf("container worker is set for secret injection but has no op:// secret reference in its environment"))
+
+			// the references may come from an env file
+			pod.Annotations["operator.1password.io/inject-env-file-configmap"] = "app-secrets"
+			rr = httptest.NewRecorder()
+			responseBody = sendPodAndGetResponse(pod, rr, warningsHandler)
+			Expect(responseBody.Warnings).To(BeEmpty())
+		})
+
+		It("warns about containers with both Connect and Service Account credentials", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject": "app",
+			}, corev1.Container{Name: "app", Command: []string{"app"}, Env: append([]corev1.EnvVar{
+				{Name: "OP_CONNECT_HOST", Value: "http://connect:8080"},
+				{Name: "OP_SERVICE_ACCOUNT_TOKEN", Value: "token"},
+			}, secretEnv...)})
+			responseBody := sendPodAndGetResponse(pod, rr, warningsHandler)
+			Expect(responseBody.Warnings).To(ConsistOf("container app sets both 1Password Connect and Service Account credentials, only one of them is used"))
+		})
+
+		It("warns about floating versions", func() {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":         "app,worker",
+				"operator.1password.io/version":        "2-beta",
+				"operator.1password.io/version.worker": "2.30.0",
+			}, testContainer("app", secretEnv...), testContainer("worker", secretEnv...))
+			responseBody := sendPodAndGetResponse(pod, rr, warningsHandler)
+			Expect(responseBody.Warnings).To(ConsistOf(`operator.1password.io/version "2-beta" is a floating tag of the 1Password CLI image, pin a version such as 2.30.0`))
+
+			// a digest pins the floating tag
+			secretInjector := SecretInjector{CredentialsPolicy: CredentialsPolicyIgnore, CLIImage: CLIImage{Digests: map[string]string{
+				"2-beta": "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			}}}
+			rr = httptest.NewRecorder()
+			responseBody = sendPodAndGetResponse(pod, rr, secretInjector.Serve)
+			Expect(responseBody.Warnings).To(BeEmpty())
+		})
+		It("does not warn about the default version", func() {
+			pod := testPod(map[string]string{"operator.1password.io/inject": "app"}, testContainer("app", secretEnv...))
+			responseBody := sendPodAndGetResponse(pod, rr, warningsHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+			Expect(responseBody.Warnings).To(BeEmpty())
+		})
+	})
+
+	Context("records events", func() {
+		var client *k8stestclient.Clientset
+		var previousClient kubernetes.Interface
+		var stopEvents chan struct{}
+		var eventsHandler http.HandlerFunc
+
+		BeforeEach(func() {
+			previousClient = k8sClient
+			client = k8stestclient.NewSimpleClientset()
+			k8sClient = client
+			stopEvents = make(chan struct{})
+			secretInjector := SecretInjector{EventRecorder: NewEventRecorder(stopEvents)}
+			eventsHandler = secretInjector.Serve
+		})
+
+		AfterEach(func() {
+			close(stopEvents)
+			k8sClient = previousClient
+		})
+
+		listEvents := func() []corev1.Event {
+			events, err := client.CoreV1().Events("default").List(context.Background(), metav1.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			return events.Items
+		}
+
+		newPod := func(inject string, owners ...metav1.OwnerReference) corev1.Pod {
+			pod := testPod(map[string]string{"operator.1password.io/inject": inject}, testContainer("app", secretEnv...))
+			pod.GenerateName, pod.Namespace, pod.OwnerReferences = "app-7d9f8b6c4-", "default", owners
+			return pod
+		}
+
+		controller := true
+
+		It("records the injection on the Deployment of the pod", func() {
+			_, err := client.AppsV1().ReplicaSets("default").Create(context.Background(), &appsv1.ReplicaSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "app-7d9f8b6c4",
+					Namespace: "default",
+					OwnerReferences: []metav1.OwnerReference{
+						{APIVersion: "apps/v1", Kind: "Deployment", Name: "app", UID: "deployment-uid", Controller: &controller},
+					},
+				},
+			}, metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			pod := newPod("app", metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app-7d9f8b6c4", UID: "replicaset-uid", Controller: &controller})
+			responseBody := sendPodAndGetResponse(pod, rr, eventsHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			Eventually(listEvents).Should(HaveLen(1))
+			event := listEvents()[0]
+			Expect(event.Type).To(Equal(corev1.EventTypeNormal))
+			Expect(event.Reason).To(Equal("SecretsInjected"))
+			Expect(event.Source.Component).To(Equal("1password-secrets-injector"))
+			Expect(event.InvolvedObject).To(Equal(corev1.ObjectReference{
+				APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "app", UID: "deployment-uid",
+			}))
+			Expect(event.Message).To(Equal("Pod app-7d9f8b6c4-: injected secrets in run mode into container(s) app with 1Password CLI image(s) 1password/op:2"))
+		})
+
+		It("records the injection on the namespace of a pod without owner", func() {
+			responseBody := sendPodAndGetResponse(newPod("app"), rr, eventsHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			Eventually(listEvents).Should(HaveLen(1))
+			event := listEvents()[0]
+			Expect(event.InvolvedObject.Kind).To(Equal("Namespace"))
+			Expect(event.InvolvedObject.Name).To(Equal("default"))
+		})
+
+		It("records skipped injections", func() {
+			responseBody := sendPodAndGetResponse(newPod("worker"), rr, eventsHandler)
+			Expect(responseBody.Patch).To(BeNil())
+
+			Eventually(listEvents).Should(HaveLen(1))
+			event := listEvents()[0]
+			Expect(event.Type).To(Equal(corev1.EventTypeNormal))
+			Expect(event.Reason).To(Equal("SecretsInjectionSkipped"))
+			Expect(event.Message).To(ContainSubstring(`no container of the pod matches operator.1password.io/inject "worker"`))
+		})
+
+		It("records failed injections", func() {
+			pod := newPod("app")
+			pod.Annotations["operator.1password.io/version"] = "2 beta"
+			responseBody := sendPodAndGetResponse(pod, rr, eventsHandler)
+			Expect(responseBody.Allowed).To(BeFalse())
+
+			Eventually(listEvents).Should(HaveLen(1))
+			event := listEvents()[0]
+			Expect(event.Type).To(Equal(corev1.EventTypeWarning))
+			Expect(event.Reason).To(Equal("SecretsInjectionFailed"))
+		})
+
+		It("aggregates repeated events", func() {
+			for i := 0; i < 2; i++ {
+				rr = httptest.NewRecorder()
+				responseBody := sendPodAndGetResponse(newPod("worker"), rr, eventsHandler)
+				Expect(responseBody.Patch).To(BeNil())
+			}
+
+			Eventually(func() int32 {
+				events := listEvents()
+				if len(events) != 1 {
+					return 0
+				}
+				return events[0].Count
+			}).Should(Equal(int32(2)))
+		})
+
+		It("records no event for dry-run requests", func() {
+			raw, err := json.Marshal(newPod("app"))
+			Expect(err).NotTo(HaveOccurred())
+			dryRun := true
+			responseBody := sendRequestAndGetResponse(&admissionv1.AdmissionRequest{
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: raw},
+				DryRun:    &dryRun,
+			}, rr, eventsHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			Consistently(listEvents).Should(BeEmpty())
+		})
+	})
+
+	Context("audits the injection", func() {
+		newPod := func(annotations map[string]string) corev1.Pod {
+			annotations["operator.1password.io/inject"] = "app"
+			pod := testPod(annotations, testContainer("app", append([]corev1.EnvVar{{Name: "OP_SERVICE_ACCOUNT_TOKEN", Value: "token"}}, secretEnv...)...))
+			pod.Name, pod.Namespace = "app", "default"
+			return pod
+		}
+
+		auditCount := func(outcome string) string {
+			if count := auditOutcomes.Get(outcome); count != nil {
+				return count.String()
+			}
+			return "0"
+		}
+
+		It("admits the pod unchanged with the patch it would apply", func() {
+			patched := auditCount("patched")
+			secretInjector := SecretInjector{Audit: true}
+			responseBody := sendPodAndGetResponse(newPod(map[string]string{}), rr, secretInjector.Serve)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+			Expect(responseBody.PatchType).To(BeNil())
+			Expect(responseBody.Warnings).To(HaveLen(1))
+			Expect(responseBody.Warnings[0]).To(MatchRegexp(`^audit mode: the secret injection would apply \d+ patch operation\(s\) to the pod, listed in the injector logs$`))
+			Expect(auditCount("patched")).NotTo(Equal(patched))
+		})
+
+		It("admits the pod it would deny", func() {
+			secretInjector := SecretInjector{Audit: true}
+			responseBody := sendPodAndGetResponse(newPod(map[string]string{"operator.1password.io/version": "2 beta"}), rr, secretInjector.Serve)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Result).To(BeNil())
+			Expect(responseBody.Warnings).To(Equal([]string{`audit mode: the secret injection would deny the pod: invalid OP CLI version "2 beta"`}))
+		})
+
+		When("the namespace is audited", func() {
+			var previousClient kubernetes.Interface
+
+			BeforeEach(func() {
+				previousClient = k8sClient
+				k8sClient = k8stestclient.NewSimpleClientset(
+					&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: map[string]string{"secrets-injection": "audit"}}},
+					&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "enforced", Labels: map[string]string{"secrets-injection": "enabled"}}},
+				)
+			})
+
+			AfterEach(func() {
+				k8sClient = previousClient
+			})
+
+			It("audits the injection in the labeled namespace only", func() {
+				responseBody := sendPodAndGetResponse(newPod(map[string]string{}), rr, handler)
+				Expect(responseBody.Allowed).To(BeTrue())
+				Expect(responseBody.Patch).To(BeNil())
+				Expect(responseBody.Warnings).To(HaveLen(1))
+
+				pod := newPod(map[string]string{})
+				pod.Namespace = "enforced"
+				raw, err := json.Marshal(pod)
+				Expect(err).NotTo(HaveOccurred())
+				rr = httptest.NewRecorder()
+				responseBody = sendRequestAndGetResponse(&admissionv1.AdmissionRequest{
+					Namespace: "enforced",
+					Object:    runtime.RawExtension{Raw: raw},
+				}, rr, handler)
+				Expect(responseBody.Patch).NotTo(BeNil())
+				Expect(responseBody.Warnings).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("applies the namespace defaults", func() {
+		var previousClient kubernetes.Interface
+
+		BeforeEach(func() {
+			previousClient = k8sClient
+			k8sClient = k8stestclient.NewSimpleClientset(&corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "default",
+					Labels: map[string]string{
+						"secrets-injection": "enabled",
+					},
+					Annotations: map[string]string{
+						"operator.1password.io/inject":     "app",
+						"operator.1password.io/version":    "2.30.0",
+						"operator.1password.io/account":    "my-team.1password.com",
+						"operator.1password.io/no-masking": "true",
+						// not an injection setting, ignored
+						"operator.1password.io/status": "injected",
+					},
+				},
+			})
+		})
+
+		AfterEach(func() {
+			k8sClient = previousClient
+		})
+
+		newPod := func(annotations map[string]string) corev1.Pod {
+			pod := testPod(annotations, testContainer("app", secretEnv...), testContainer("worker", secretEnv...))
+			pod.Name = "app"
+			return pod
+		}
+
+		It("injects pods without annotations with the namespace configuration", func() {
+			pod := newPod(nil)
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers[0].Image).To(Equal("1password/op:2.30.0"))
+			Expect(patched.Spec.Containers[0].Command).To(Equal([]string{"/op/bin/op", "run", "--account=my-team.1password.com", "--no-masking", "--", "app"}))
+			Expect(patched.Spec.Containers[1].Command).To(Equal([]string{"worker"}))
+			// only the injection status is added to the pod annotations
+			Expect(patched.Annotations).To(Equal(map[string]string{"operator.1password.io/status": "injected"}))
+		})
+
+		It("lets the pod annotations override the namespace defaults", func() {
+			pod := newPod(map[string]string{
+				"operator.1password.io/inject":     "worker",
+				"operator.1password.io/version":    "2.18.0",
+				"operator.1password.io/no-masking": "false",
+			})
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.InitContainers[0].Image).To(Equal("1password/op:2.18.0"))
+			Expect(patched.Spec.Containers[0].Command).To(Equal([]string{"app"}))
+			Expect(patched.Spec.Containers[1].Command).To(Equal([]string{"/op/bin/op", "run", "--account=my-team.1password.com", "--", "worker"}))
+		})
+
+		It("lets pods opt out of the injection", func() {
+			responseBody := sendPodAndGetResponse(newPod(map[string]string{"operator.1password.io/inject": "False"}), rr, handler)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+			Expect(responseBody.Warnings).To(BeEmpty())
+		})
+
+		It("reads the namespaces from the cache", func() {
+			stop := make(chan struct{})
+			defer close(stop)
+			namespaces, err := NewNamespaceLister(stop)
+			Expect(err).NotTo(HaveOccurred())
+
+			secretInjector := SecretInjector{Namespaces: namespaces}
+			pod := newPod(nil)
+			responseBody := sendPodAndGetResponse(pod, rr, secretInjector.Serve)
+			Expect(responseBody.Patch).NotTo(BeNil())
+			Expect(applyPatchToPod(pod, responseBody).Spec.InitContainers[0].Image).To(Equal("1password/op:2.30.0"))
+		})
+
+		It("reads the namespaces missing from the cache from the API server", func() {
+			// e.g. a namespace created with its pods, before the cache was updated
+			empty := corev1listers.NewNamespaceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+
+			secretInjector := SecretInjector{Namespaces: empty}
+			pod := newPod(nil)
+			responseBody := sendPodAndGetResponse(pod, rr, secretInjector.Serve)
+			Expect(responseBody.Patch).NotTo(BeNil())
+			Expect(applyPatchToPod(pod, responseBody).Spec.InitContainers[0].Image).To(Equal("1password/op:2.30.0"))
+		})
+	})
+
+	Context("handles pod updates", func() {
+		newPod := func() corev1.Pod {
+			app := testContainer("app", secretEnv...)
+			app.Image = "app:1.0"
+			pod := testPod(map[string]string{"operator.1password.io/inject": "app"}, app)
+			pod.Name = "app"
+			return pod
+		}
+
+		sendUpdate := func(oldPod, pod corev1.Pod, handler http.HandlerFunc) *admissionv1.AdmissionResponse {
+			oldRaw, err := json.Marshal(oldPod)
+			Expect(err).NotTo(HaveOccurred())
+			raw, err := json.Marshal(pod)
+			Expect(err).NotTo(HaveOccurred())
+			rr = httptest.NewRecorder()
+			return sendRequestAndGetResponse(&admissionv1.AdmissionRequest{
+				Namespace: "default",
+				Operation: admissionv1.Update,
+				Object:    runtime.RawExtension{Raw: raw},
+				OldObject: runtime.RawExtension{Raw: oldRaw},
+			}, rr, handler)
+		}
+
+		injectedPod := func() corev1.Pod {
+			pod := newPod()
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+			return applyPatchToPod(pod, responseBody)
+		}
+
+		It("never patches updated pods", func() {
+			// e.g. a pod created before the injector was deployed
+			pod := newPod()
+			updated := newPod()
+			updated.Labels = map[string]string{"version": "1.1"}
+			responseBody := sendUpdate(pod, updated, handler)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+		})
+
+		It("admits any update of injected pods by default", func() {
+			injected := injectedPod()
+			updated := *injected.DeepCopy()
+			delete(updated.Annotations, "operator.1password.io/status")
+			responseBody := sendUpdate(injected, updated, handler)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+		})
+
+		When("the injection is protected", func() {
+			var protectingHandler http.HandlerFunc
+
+			BeforeAll(func() {
+				secretInjector := SecretInjector{ProtectInjection: true}
+				protectingHandler = secretInjector.Serve
+			})
+
+			It("denies changing the injection status", func() {
+				injected := injectedPod()
+				updated := *injected.DeepCopy()
+				delete(updated.Annotations, "operator.1password.io/status")
+				responseBody := sendUpdate(injected, updated, protectingHandler)
+				Expect(responseBody.Allowed).To(BeFalse())
+				Expect(responseBody.Result.Message).To(Equal("the operator.1password.io/status annotation of an injected pod can't be changed"))
+			})
+
+			It("denies changing the image of the injected init containers", func() {
+				injected := injectedPod()
+				updated := *injected.DeepCopy()
+				updated.Spec.InitContainers[0].Image = "attacker/op:2"
+				responseBody := sendUpdate(injected, updated, protectingHandler)
+				Expect(responseBody.Allowed).To(BeFalse())
+				Expect(responseBody.Result.Message).To(Equal("the image of the injected init container copy-op-bin can't be changed"))
+			})
+
+			It("admits the other updates", func() {
+				injected := injectedPod()
+				updated := *injected.DeepCopy()
+				updated.Spec.Containers[0].Image = "app:1.1"
+				updated.Annotations["team"] = "payments"
+				responseBody := sendUpdate(injected, updated, protectingHandler)
+				Expect(responseBody.Allowed).To(BeTrue())
+				Expect(responseBody.Patch).To(BeNil())
+
+				// pods that were not injected can be updated freely
+				pod := newPod()
+				updated = newPod()
+				updated.Annotations["operator.1password.io/status"] = "injected"
+				responseBody = sendUpdate(pod, updated, protectingHandler)
+				Expect(responseBody.Allowed).To(BeTrue())
+			})
+		})
+	})
+
+	Context("admits the pod templates of workloads", func() {
+		deploymentsResource := metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+		newDeployment := func(annotations map[string]string) appsv1.Deployment {
+			annotations["operator.1password.io/inject"] = "app"
+			return appsv1.Deployment{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels:      map[string]string{"app": "app"},
+							Annotations: annotations,
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{Name: "app", Command: []string{"app"}, Env: secretEnv}},
+						},
+					},
+				},
+			}
+		}
+
+		sendWorkload := func(object interface{}, name string, resource metav1.GroupVersionResource, mode WorkloadMode, templates ...WorkloadTemplate) (*admissionv1.AdmissionResponse, []byte) {
+			raw, err := json.Marshal(object)
+			Expect(err).NotTo(HaveOccurred())
+			secretInjector := SecretInjector{Workloads: mode, WorkloadTemplates: append(DefaultWorkloadTemplates, templates...)}
+			responseBody := sendRequestAndGetResponse(&admissionv1.AdmissionRequest{
+				Namespace: "default",
+				Name:      name,
+				Operation: admissionv1.Create,
+				Resource:  resource,
+				Object:    runtime.RawExtension{Raw: raw},
+			}, rr, secretInjector.Serve)
+			return responseBody, raw
+		}
+
+		applyPatch := func(raw []byte, response *admissionv1.AdmissionResponse, object interface{}) {
+			patch, err := jsonpatch.DecodePatch(response.Patch)
+			Expect(err).NotTo(HaveOccurred())
+			patchedRaw, err := patch.Apply(raw)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(json.Unmarshal(patchedRaw, object)).To(Succeed())
+		}
+
+		It("injects the secrets into the pod template of a Deployment", func() {
+			responseBody, raw := sendWorkload(newDeployment(map[string]string{}), "app", deploymentsResource, WorkloadsMutate)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			var patched appsv1.Deployment
+			applyPatch(raw, responseBody, &patched)
+			template := patched.Spec.Template
+			Expect(template.Annotations).To(HaveKeyWithValue("operator.1password.io/status", "injected"))
+			Expect(template.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+			Expect(template.Spec.Containers[0].Command).To(Equal([]string{"/op/bin/op", "run", "--", "app"}))
+			Expect(patched.Spec.Template.Labels).To(Equal(map[string]string{"app": "app"}))
+		})
+
+		sendWorkloadUpdate := func(oldObject, object interface{}, name string, resource metav1.GroupVersionResource) *admissionv1.AdmissionResponse {
+			oldRaw, err := json.Marshal(oldObject)
+			Expect(err).NotTo(HaveOccurred())
+			raw, err := json.Marshal(object)
+			Expect(err).NotTo(HaveOccurred())
+			secretInjector := SecretInjector{Workloads: WorkloadsMutate, WorkloadTemplates: DefaultWorkloadTemplates}
+			rr = httptest.NewRecorder()
+			return sendRequestAndGetResponse(&admissionv1.AdmissionRequest{
+				Namespace: "default",
+				Name:      name,
+				Operation: admissionv1.Update,
+				Resource:  resource,
+				Object:    runtime.RawExtension{Raw: raw},
+				OldObject: runtime.RawExtension{Raw: oldRaw},
+			}, rr, secretInjector.Serve)
+		}
+
+		It("does not inject the pod template of a Deployment again on updates", func() {
+			deployment := newDeployment(map[string]string{})
+			deployment.Spec.Template.Annotations["operator.1password.io/inject"] = "*"
+			responseBody, raw := sendWorkload(deployment, "app", deploymentsResource, WorkloadsMutate)
+			var injected appsv1.Deployment
+			applyPatch(raw, responseBody, &injected)
+
+			// e.g. scaled by kubectl apply
+			updated := *injected.DeepCopy()
+			replicas := int32(3)
+			updated.Spec.Replicas = &replicas
+			responseBody = sendWorkloadUpdate(injected, updated, "app", deploymentsResource)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+			Expect(updated.Spec.Template.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+			Expect(updated.Spec.Template.Spec.InitContainers[0].Command).To(Equal([]string{"sh", "-c", "cp /usr/local/bin/op /op/bin/"}))
+
+			// a changed template is validated, its pods are injected by the pod webhook
+			updated.Spec.Template.Spec.Containers = append(updated.Spec.Template.Spec.Containers, corev1.Container{Name: "worker", Command: []string{"worker"}, Env: secretEnv})
+			responseBody = sendWorkloadUpdate(injected, updated, "app", deploymentsResource)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+
+			updated.Spec.Template.Annotations["operator.1password.io/version"] = "2 beta"
+			responseBody = sendWorkloadUpdate(injected, updated, "app", deploymentsResource)
+			Expect(responseBody.Allowed).To(BeFalse())
+		})
+
+		It("admits the updates of a Job created before its template could be injected", func() {
+			job := batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{Name: "migrate", Namespace: "default"},
+				Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"operator.1password.io/inject": "migrate"}},
+					Spec: corev1.PodSpec{
+						RestartPolicy: corev1.RestartPolicyNever,
+						Containers:    []corev1.Container{{Name: "migrate", Command: []string{"migrate"}, Env: secretEnv}},
+					},
+				}},
+			}
+			updated := *job.DeepCopy()
+			updated.Labels = map[string]string{"team": "platform"}
+			responseBody := sendWorkloadUpdate(job, updated, "migrate", metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"})
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+		})
+
+		It("injects the job template of a CronJob", func() {
+			cronJob := batchv1.CronJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "report", Namespace: "default"},
+				Spec: batchv1.CronJobSpec{
+					Schedule: "0 * * * *",
+					JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"operator.1password.io/inject": "report"}},
+						Spec: corev1.PodSpec{
+							RestartPolicy: corev1.RestartPolicyNever,
+							Containers:    []corev1.Container{{Name: "report", Command: []string{"report"}, Env: secretEnv}},
+						},
+					}}},
+				},
+			}
+			responseBody, raw := sendWorkload(cronJob, "report", metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"}, WorkloadsMutate)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			var patched batchv1.CronJob
+			applyPatch(raw, responseBody, &patched)
+			Expect(patched.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Command).To(Equal([]string{"/op/bin/op", "run", "--", "report"}))
+		})
+
+		It("validates the pod template without changing it", func() {
+			responseBody, _ := sendWorkload(newDeployment(map[string]string{}), "app", deploymentsResource, WorkloadsValidate)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+
+			rr = httptest.NewRecorder()
+			responseBody, _ = sendWorkload(newDeployment(map[string]string{"operator.1password.io/version": "2 beta"}), "app", deploymentsResource, WorkloadsValidate)
+			Expect(responseBody.Allowed).To(BeFalse())
+			Expect(responseBody.Result.Message).To(Equal(`pod template of deployments app: invalid OP CLI version "2 beta"`))
+		})
+
+		It("returns the warnings about the pod template", func() {
+			deployment := newDeployment(map[string]string{})
+			deployment.Spec.Template.Annotations["operator.1password.io/inject"] = "app,wroker"
+			responseBody, _ := sendWorkload(deployment, "app", deploymentsResource, WorkloadsValidate)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Warnings).To(ContainElement("container wroker is referenced by the secret injection annotations but is not in the pod"))
+		})
+
+		It("injects the pod template of a custom resource at the configured path", func() {
+			templates, err := ParseWorkloadTemplates("argoproj.io/v1alpha1/rollouts=/spec/template")
+			Expect(err).NotTo(HaveOccurred())
+
+			rollout := map[string]interface{}{
+				"apiVersion": "argoproj.io/v1alpha1",
+				"kind":       "Rollout",
+				"metadata":   map[string]interface{}{"name": "app", "namespace": "default", "annotations": map[string]interface{}{"operator.1password.io/inject": "app"}},
+				"spec": map[string]interface{}{
+					"strategy": map[string]interface{}{"canary": map[string]interface{}{}},
+					// a template without metadata, the injection is configured by the namespace
+					"template": map[string]interface{}{
+						"spec": map[string]interface{}{
+							"containers": []interface{}{map[string]interface{}{"name": "app", "command": []interface{}{"app"}}},
+						},
+					},
+				},
+			}
+			previousClient := k8sClient
+			defer func() { k8sClient = previousClient }()
+			k8sClient = k8stestclient.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        "default",
+				Annotations: map[string]string{"operator.1password.io/inject": "app"},
+			}})
+
+			responseBody, raw := sendWorkload(rollout, "app", metav1.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}, WorkloadsMutate, templates...)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			var patched struct {
+				Spec struct {
+					Template corev1.PodTemplateSpec `json:"template"`
+				} `json:"spec"`
+			}
+			applyPatch(raw, responseBody, &patched)
+			Expect(patched.Spec.Template.Annotations).To(Equal(map[string]string{"operator.1password.io/status": "injected"}))
+			Expect(patched.Spec.Template.Spec.Containers[0].Command).To(Equal([]string{"/op/bin/op", "run", "--", "app"}))
+		})
+
+		It("ignores the workloads when disabled", func() {
+			responseBody, _ := sendWorkload(newDeployment(map[string]string{}), "app", deploymentsResource, WorkloadsDisabled)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+		})
+
+		It("parses the workload configuration", func() {
+			mode, err := ParseWorkloadMode("Mutate")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mode).To(Equal(WorkloadsMutate))
+			_, err = ParseWorkloadMode("enforce")
+			Expect(err).To(HaveOccurred())
+
+			templates, err := ParseWorkloadTemplates("argoproj.io/v1alpha1/rollouts=/spec/template, /v1/replicationcontrollers=/spec/template")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(templates).To(Equal([]WorkloadTemplate{
+				{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts", Path: "/spec/template"},
+				{Group: "", Version: "v1", Resource: "replicationcontrollers", Path: "/spec/template"},
+			}))
+			_, err = ParseWorkloadTemplates("argoproj.io/rollouts=/spec/template")
+			Expect(err).To(HaveOccurred())
+			_, err = ParseWorkloadTemplates("argoproj.io/v1alpha1/rollouts=spec.template")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("registers the workloads in the webhook configuration", func() {
+			previousClient := k8sClient
+			defer func() { k8sClient = previousClient }()
+			k8sClient = k8stestclient.NewSimpleClientset()
+
+			templates := append(DefaultWorkloadTemplates, WorkloadTemplate{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts", Path: "/spec/template"})
+			Expect(CreateOrUpdateMutatingWebhookConfiguration(bytes.NewBufferString("ca"), "secrets-injector-svc", "secrets-injector", templates, nil)).To(Succeed())
+
+			config, err := k8sClient.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), "secrets-injector-webhook-config", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Webhooks).To(HaveLen(2))
+			Expect(*config.Webhooks[0].TimeoutSeconds).To(BeNumerically(">", admissionTimeout.Seconds()))
+			Expect(*config.Webhooks[1].TimeoutSeconds).To(Equal(*config.Webhooks[0].TimeoutSeconds))
+			rules := config.Webhooks[1].Rules
+			Expect(rules).To(HaveLen(3))
+			Expect(rules[0].APIGroups).To(Equal([]string{"apps"}))
+			Expect(rules[0].Resources).To(Equal([]string{"deployments", "statefulsets", "daemonsets"}))
+			Expect(rules[1].Resources).To(Equal([]string{"jobs", "cronjobs"}))
+			Expect(rules[2].APIGroups).To(Equal([]string{"argoproj.io"}))
+		})
+	})
+
+	Context("opts objects out of the webhook", func() {
+		It("only sends the objects matching the object selector to the webhook", func() {
+			previousClient := k8sClient
+			defer func() { k8sClient = previousClient }()
+			k8sClient = k8stestclient.NewSimpleClientset()
+
+			selector, err := metav1.ParseToLabelSelector("secrets-injection notin (disabled)")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(CreateOrUpdateMutatingWebhookConfiguration(bytes.NewBufferString("ca"), "secrets-injector-svc", "secrets-injector", DefaultWorkloadTemplates, selector)).To(Succeed())
+
+			config, err := k8sClient.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), "secrets-injector-webhook-config", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			expected := []metav1.LabelSelectorRequirement{
+				{Key: "secrets-injection", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"disabled"}},
+			}
+			Expect(config.Webhooks[0].ObjectSelector.MatchExpressions).To(Equal(expected))
+			Expect(config.Webhooks[1].ObjectSelector.MatchExpressions).To(Equal(expected))
+		})
+	})
+
+	Context("is idempotent", func() {
+		newPod := func() corev1.Pod {
+			pod := testPod(map[string]string{
+				"operator.1password.io/inject":                    "app,migrate",
+				"operator.1password.io/inject-files-configmap":    "app-templates",
+				"operator.1password.io/inject-env-file-configmap": "app-secrets",
+			}, testContainer("app", secretEnv...))
+			pod.Spec.InitContainers = []corev1.Container{testContainer("migrate")}
+			return pod
+		}
+
+		It("does not patch an injected pod again when its status annotation was removed", func() {
+			pod := newPod()
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+			injected := applyPatchToPod(pod, responseBody)
+
+			delete(injected.Annotations, "operator.1password.io/status")
+			rr = httptest.NewRecorder()
+			responseBody = sendPodAndGetResponse(injected, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			var patch []patchOperation
+			Expect(json.Unmarshal(responseBody.Patch, &patch)).To(Succeed())
+			Expect(patch).To(HaveLen(1))
+			Expect(patch[0].Path).To(Equal("/metadata/annotations/operator.1password.io~1status"))
+
+			reinjected := applyPatchToPod(injected, responseBody)
+			Expect(reinjected.Spec).To(Equal(injected.Spec))
+		})
+
+		It("does not inject the init containers of a previous injection into all containers", func() {
+			pod := newPod()
+			pod.Annotations["operator.1password.io/inject"] = "*"
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+			injected := applyPatchToPod(pod, responseBody)
+			Expect(injected.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+			Expect(injected.Spec.InitContainers[1].Name).To(Equal("op-inject-files"))
+
+			// the pod is recreated from the manifest of the injected pod
+			delete(injected.Annotations, "operator.1password.io/status")
+			rr = httptest.NewRecorder()
+			responseBody = sendPodAndGetResponse(injected, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			var patch []patchOperation
+			Expect(json.Unmarshal(responseBody.Patch, &patch)).To(Succeed())
+			Expect(patch).To(HaveLen(1))
+			Expect(patch[0].Path).To(Equal("/metadata/annotations/operator.1password.io~1status"))
+			Expect(applyPatchToPod(injected, responseBody).Spec).To(Equal(injected.Spec))
+		})
+
+		It("does not patch a fully injected pod", func() {
+			pod := newPod()
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			injected := applyPatchToPod(pod, responseBody)
+
+			// e.g. when the API server reinvokes the webhook after another webhook changed the pod
+			rr = httptest.NewRecorder()
+			responseBody = sendPodAndGetResponse(injected, rr, handler)
+			Expect(responseBody.Allowed).To(BeTrue())
+			Expect(responseBody.Patch).To(BeNil())
+		})
+
+		It("only adds the missing artifacts", func() {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"operator.1password.io/inject": "app",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{binVolume},
+					Containers: []corev1.Container{
+						{
+							Name:         "app",
+							Command:      []string{"/op/bin/op", "run", "--", "app"},
+							VolumeMounts: []corev1.VolumeMount{binVolumeMount},
+						},
+					},
+				},
+			}
+			responseBody := sendPodAndGetResponse(pod, rr, handler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Volumes).To(Equal([]corev1.Volume{binVolume}))
+			Expect(patched.Spec.InitContainers).To(HaveLen(1))
+			Expect(patched.Spec.InitContainers[0].Name).To(Equal("copy-op-bin"))
+
+			app := patched.Spec.Containers[0]
+			Expect(app.Command).To(Equal([]string{"/op/bin/op", "run", "--", "app"}))
+			Expect(app.VolumeMounts).To(Equal([]corev1.VolumeMount{binVolumeMount}))
+			Expect(app.Env).To(HaveLen(3))
+		})
+	})
+
+	Context("resolves the image command", func() {
+		var imageRegistry *httptest.Server
+		var registryHandler http.HandlerFunc
+		var image string
+
+		BeforeAll(func() {
+			imageRegistry = newImageRegistry("team/app", []string{"/entrypoint.sh"}, []string{"serve", "--port=80"})
+			image = strings.TrimPrefix(imageRegistry.URL, "http://") + "/team/app:1.0"
+
+			secretInjector := SecretInjector{Registry: registry.NewClient()}
+			registryHandler = secretInjector.Serve
+
+			_, err := k8sClient.CoreV1().Secrets("default").Create(context.Background(), &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "registry-credentials", Namespace: "default"},
+				Type:       corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigJsonKey: []byte(`{"auths":{"` + strings.TrimPrefix(imageRegistry.URL, "http://") + `":{"username":"user","password":"pass"}}}`),
+				},
+			}, metav1.CreateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterAll(func() {
+			imageRegistry.Close()
+		})
+
+		newPod := func(args []string) corev1.Pod {
+			pod := testPod(map[string]string{"operator.1password.io/inject": "app"}, corev1.Container{Name: "app", Image: image, Args: args})
+			pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "registry-credentials"}}
+			return pod
+		}
+
+		It("wraps the image ENTRYPOINT and passes the image CMD as args", func() {
+			pod := newPod(nil)
+			responseBody := sendPodAndGetResponse(pod, rr, registryHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Containers[0].Command).To(Equal([]string{"/op/bin/op", "run", "--", "/entrypoint.sh"}))
+			Expect(patched.Spec.Containers[0].Args).To(Equal([]string{"serve", "--port=80"}))
+		})
+
+		It("keeps the container args over the image CMD", func() {
+			pod := newPod([]string{"migrate"})
+			responseBody := sendPodAndGetResponse(pod, rr, registryHandler)
+			Expect(responseBody.Patch).NotTo(BeNil())
+
+			patched := applyPatchToPod(pod, responseBody)
+			Expect(patched.Spec.Containers[0].Command).To(Equal([]string{"/op/bin/op", "run", "--", "/entrypoint.sh"}))
+			Expect(patched.Spec.Containers[0].Args).To(Equal([]string{"migrate"}))
+		})
+
+		It("does not patch the pod when the registry can't be authenticated against", func() {
+			pod := newPod(nil)
+			pod.Spec.ImagePullSecrets = nil
+			responseBody := sendPodAndGetResponse(pod, rr, registryHandler)
+			Expect(responseBody.Patch).To(BeNil())
+			Expect(responseBody.Result.Message).To(ContainSubstring("the image command could not be resolved"))
+		})
+
+		It("does not patch the pod when the image command isn't resolved in time", func() {
+			pod := newPod(nil)
+			raw, err := json.Marshal(pod)
+			Expect(err).NotTo(HaveOccurred())
+			body, err := json.Marshal(admissionv1.AdmissionReview{
+				Request: &admissionv1.AdmissionRequest{
+					Namespace: "default",
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// the API server gave up on the request
+			ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+			defer cancel()
+			registryHandler.ServeHTTP(rr, createRequest(bytes.NewReader(body)).WithContext(ctx))
+			responseBody := parseResponseBody(rr)
+			Expect(responseBody.Patch).To(BeNil())
+			Expect(responseBody.Result.Message).To(ContainSubstring("could not resolve image command in time"))
+		})
+	})
 })
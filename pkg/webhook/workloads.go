@@ -0,0 +1,219 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/golang/glog"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WorkloadMode is how the injector admits the pod templates of the workloads.
+type WorkloadMode string
+
+const (
+	// WorkloadsDisabled only admits pods.
+	WorkloadsDisabled WorkloadMode = ""
+	// WorkloadsValidate denies the workloads whose pods would be denied, without changing them.
+	WorkloadsValidate WorkloadMode = "validate"
+	// WorkloadsMutate injects the secrets into the pod templates of the workloads.
+	WorkloadsMutate WorkloadMode = "mutate"
+)
+
+// ParseWorkloadMode validates a workload mode, disabled being the default.
+func ParseWorkloadMode(value string) (WorkloadMode, error) {
+	switch mode := WorkloadMode(strings.ToLower(strings.TrimSpace(value))); mode {
+	case WorkloadsDisabled, WorkloadsValidate, WorkloadsMutate:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid workload mode %q, expected %q or %q", value, WorkloadsValidate, WorkloadsMutate)
+	}
+}
+
+// WorkloadTemplate locates the pod template of a workload resource.
+type WorkloadTemplate struct {
+	Group    string // API group of the resource, empty for the core group
+	Version  string // API version of the resource
+	Resource string // plural name of the resource, e.g. deployments
+	Path     string // JSON pointer to the pod template in the resource, e.g. /spec/template
+}
+
+// DefaultWorkloadTemplates are the built-in workload resources.
+var DefaultWorkloadTemplates = []WorkloadTemplate{
+	{Group: "apps", Version: "v1", Resource: "deployments", Path: "/spec/template"},
+	{Group: "apps", Version: "v1", Resource: "statefulsets", Path: "/spec/template"},
+	{Group: "apps", Version: "v1", Resource: "daemonsets", Path: "/spec/template"},
+	{Group: "batch", Version: "v1", Resource: "jobs", Path: "/spec/template"},
+	{Group: "batch", Version: "v1", Resource: "cronjobs", Path: "/spec/jobTemplate/spec/template"},
+}
+
+// ParseWorkloadTemplates parses a comma separated list of `<group>/<version>/<resource>=<path>` workload templates,
+// e.g. argoproj.io/v1alpha1/rollouts=/spec/template.
+func ParseWorkloadTemplates(value string) ([]WorkloadTemplate, error) {
+	var templates []WorkloadTemplate
+	for _, pair := range parseList(value) {
+		resource, path, ok := strings.Cut(pair, "=")
+		parts := strings.Split(strings.TrimSpace(resource), "/")
+		path = strings.TrimSpace(path)
+		if !ok || len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid workload template %q, expected <group>/<version>/<resource>=<path>", pair)
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid pod template path %q for %s, expected a JSON pointer such as /spec/template", path, resource)
+		}
+		templates = append(templates, WorkloadTemplate{Group: parts[0], Version: parts[1], Resource: parts[2], Path: path})
+	}
+	return templates, nil
+}
+
+// workloadTemplate returns the workload template of the requested resource, if it's an admitted workload.
+func (s *SecretInjector) workloadTemplate(resource metav1.GroupVersionResource) (WorkloadTemplate, bool) {
+	if s.Workloads == WorkloadsDisabled {
+		return WorkloadTemplate{}, false
+	}
+	for _, template := range s.WorkloadTemplates {
+		if template.Group == resource.Group && template.Version == resource.Version && template.Resource == resource.Resource {
+			return template, true
+		}
+	}
+	return WorkloadTemplate{}, false
+}
+
+type templateContextKey struct{}
+
+// isTemplate reports whether the admission of the context is the one of a workload's pod template,
+// about which no event is recorded: the pods created from the template report their own injection.
+func isTemplate(ctx context.Context) bool {
+	template, _ := ctx.Value(templateContextKey{}).(bool)
+	return template
+}
+
+// mutateWorkload admits the pod template of a workload as if it was a pod, so that a workload whose pods would
+// be denied is denied too, and, in mutate mode, so that the injection shows in the workload.
+// The pod templates are only injected when the workloads are created: the template of some workloads, e.g. Jobs,
+// can't be changed afterwards, and the pods created from an updated template are injected by the pod webhook anyway.
+// On updates, the changed templates are only validated.
+func (s *SecretInjector) mutateWorkload(ctx context.Context, req *admissionv1.AdmissionRequest, workload WorkloadTemplate, defaults map[string]string) *admissionv1.AdmissionResponse {
+	var object map[string]interface{}
+	if err := json.Unmarshal(req.Object.Raw, &object); err != nil {
+		glog.Errorf("Could not unmarshal raw object: %v", err)
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	value, found := lookupJSONPointer(object, workload.Path)
+	template, ok := value.(map[string]interface{})
+	if !found || !ok {
+		glog.Infof("No pod template at %s in %s %s/%s", workload.Path, workload.Resource, req.Namespace, req.Name)
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	mode := s.Workloads
+	if req.Operation == admissionv1.Update {
+		if !templateChanged(req, workload, template) {
+			return &admissionv1.AdmissionResponse{
+				Allowed: true,
+			}
+		}
+		mode = WorkloadsValidate
+	}
+
+	var podTemplate corev1.PodTemplateSpec
+	raw, err := json.Marshal(template)
+	if err == nil {
+		err = json.Unmarshal(raw, &podTemplate)
+	}
+	if err != nil {
+		glog.Errorf("Could not unmarshal the pod template of %s %s/%s: %v", workload.Resource, req.Namespace, req.Name, err)
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("invalid pod template at %s: %v", workload.Path, err),
+			},
+		}
+	}
+
+	pod := corev1.Pod{ObjectMeta: podTemplate.ObjectMeta, Spec: podTemplate.Spec}
+	pod.Name = req.Name
+	pod.Namespace = req.Namespace
+	// the template is injected again on every update, which only adds the missing artifacts
+	delete(pod.Annotations, injectionStatus)
+
+	response := s.mutatePod(context.WithValue(ctx, templateContextKey{}, true), req, &pod, defaults)
+	if !response.Allowed && response.Result != nil {
+		response.Result.Message = fmt.Sprintf("pod template of %s %s: %s", workload.Resource, req.Name, response.Result.Message)
+		return response
+	}
+	if len(response.Patch) == 0 {
+		return response
+	}
+	if mode != WorkloadsMutate {
+		response.Patch = nil
+		response.PatchType = nil
+		return response
+	}
+
+	var patch []patchOperation
+	if _, ok := template["metadata"]; !ok {
+		patch = append(patch, patchOperation{Op: "add", Path: workload.Path + "/metadata", Value: map[string]interface{}{}})
+	}
+	var templatePatch []patchOperation
+	if err := json.Unmarshal(response.Patch, &templatePatch); err != nil {
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+	for _, op := range templatePatch {
+		op.Path = workload.Path + op.Path
+		patch = append(patch, op)
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+	warnings := response.Warnings
+	response = patchResponse(patchBytes)
+	response.Warnings = warnings
+	return response
+}
+
+// templateChanged reports whether the update of the workload changes its pod template.
+func templateChanged(req *admissionv1.AdmissionRequest, workload WorkloadTemplate, template map[string]interface{}) bool {
+	var oldObject map[string]interface{}
+	if err := json.Unmarshal(req.OldObject.Raw, &oldObject); err != nil {
+		return true
+	}
+	oldTemplate, found := lookupJSONPointer(oldObject, workload.Path)
+	return !found || !reflect.DeepEqual(oldTemplate, template)
+}
+
+// lookupJSONPointer returns the value at the JSON pointer in the object.
+func lookupJSONPointer(object map[string]interface{}, pointer string) (interface{}, bool) {
+	var value interface{} = object
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		parent, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = parent[token]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}